@@ -0,0 +1,189 @@
+package borda
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/yaml"
+)
+
+const (
+	// APIKeyDimension is the dimension in which the identity of the API key
+	// with which a measurement was submitted is recorded, overwriting any
+	// dimension of the same name submitted by the client.
+	APIKeyDimension = "api_key"
+
+	// DefaultBurstSeconds determines the default burst of an API key's rate
+	// quota, as the number of seconds' worth of its rate. It corresponds to the
+	// client's default batch interval.
+	DefaultBurstSeconds = 300
+)
+
+// APIKey is a key with which clients authenticate to submit measurements.
+type APIKey struct {
+	// ID identifies the source to which the key was issued. It's recorded in
+	// the APIKeyDimension of the key's measurements.
+	ID string `yaml:"id"`
+
+	// Names are the names of the measurements that may be submitted with the
+	// key, either exact or patterns as understood by path.Match. If empty, all
+	// names are allowed.
+	Names []string `yaml:"names"`
+
+	// Rate is how many measurements per second may be submitted with the key.
+	// If 0, the rate isn't limited.
+	Rate float64 `yaml:"rate"`
+
+	// Burst is how many measurements may be submitted at once, defaulting to
+	// DefaultBurstSeconds worth of Rate.
+	Burst float64 `yaml:"burst"`
+
+	quota *tokenBucket
+}
+
+// allows checks whether the key allows submitting measurements with the given
+// name.
+func (k *APIKey) allows(name string) bool {
+	if len(k.Names) == 0 {
+		return true
+	}
+	for _, pattern := range k.Names {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// APIKeys holds the API keys loaded from a file, which can be reloaded while
+// the keys are in use.
+type APIKeys struct {
+	file    string
+	keys    map[string]*APIKey
+	modTime time.Time
+	mx      sync.RWMutex
+}
+
+type apiKeysConfig struct {
+	Keys map[string]*APIKey `yaml:"keys"`
+}
+
+// LoadAPIKeys loads API keys from the given YAML file, which looks like:
+//
+//	keys:
+//	  0b8a1c2d3e4f:
+//	    id: lantern-desktop
+//	    names: [client_*, proxy_*]
+//	    rate: 1000
+//	    burst: 100000
+//
+// Keys are the secrets that clients send in the wire.APIKeyHeader.
+func LoadAPIKeys(file string) (*APIKeys, error) {
+	k := &APIKeys{file: file}
+	err := k.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Reload reloads the keys from file. Rate quotas of keys that didn't change
+// are carried over. If the file can't be loaded, the current keys are kept.
+func (k *APIKeys) Reload() error {
+	info, err := os.Stat(k.file)
+	if err != nil {
+		return errors.New("Unable to stat API keys file %v: %v", k.file, err)
+	}
+	b, err := ioutil.ReadFile(k.file)
+	if err != nil {
+		return errors.New("Unable to read API keys file %v: %v", k.file, err)
+	}
+	cfg := &apiKeysConfig{}
+	err = yaml.Unmarshal(b, cfg)
+	if err != nil {
+		return errors.New("Unable to parse API keys file %v: %v", k.file, err)
+	}
+	for secret, key := range cfg.Keys {
+		if secret == "" {
+			return errors.New("API key %d in %v is empty", keyPosition(b, secret), k.file)
+		}
+		if key == nil || key.ID == "" {
+			return errors.New("API key %d in %v has no id", keyPosition(b, secret), k.file)
+		}
+		for _, pattern := range key.Names {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return errors.New("Invalid name pattern %v for API key %v: %v", pattern, key.ID, err)
+			}
+		}
+		if key.Rate > 0 {
+			if key.Burst <= 0 {
+				key.Burst = key.Rate * DefaultBurstSeconds
+			}
+			key.quota = newTokenBucket(key.Rate, key.Burst)
+		}
+	}
+
+	k.mx.Lock()
+	for secret, key := range cfg.Keys {
+		if old, found := k.keys[secret]; found && old.Rate == key.Rate && old.Burst == key.Burst {
+			key.quota = old.quota
+		}
+	}
+	k.keys = cfg.Keys
+	k.modTime = info.ModTime()
+	k.mx.Unlock()
+	log.Debugf("Loaded %d API keys from %v", len(cfg.Keys), k.file)
+	return nil
+}
+
+// keyPosition returns the position (starting at 1) of the key with the given
+// secret in the file's contents, which identifies the key in errors without
+// revealing its secret.
+func keyPosition(b []byte, secret string) int {
+	cfg := &struct {
+		Keys yaml.MapSlice `yaml:"keys"`
+	}{}
+	yaml.Unmarshal(b, cfg)
+	for i, item := range cfg.Keys {
+		if fmt.Sprint(item.Key) == secret {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// ReloadPeriodically checks every interval whether the file has changed and if
+// so, reloads it. It never returns.
+func (k *APIKeys) ReloadPeriodically(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		info, err := os.Stat(k.file)
+		if err != nil {
+			log.Errorf("Unable to check API keys file %v for changes: %v", k.file, err)
+			continue
+		}
+		k.mx.RLock()
+		changed := !info.ModTime().Equal(k.modTime)
+		k.mx.RUnlock()
+		if changed {
+			if err := k.Reload(); err != nil {
+				log.Errorf("Unable to reload API keys, keeping current keys: %v", err)
+			}
+		}
+	}
+}
+
+// get returns the key with the given secret, or nil if there is none.
+func (k *APIKeys) get(secret string) *APIKey {
+	if secret == "" {
+		return nil
+	}
+	k.mx.RLock()
+	defer k.mx.RUnlock()
+	return k.keys[secret]
+}
@@ -0,0 +1,96 @@
+package borda
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/getlantern/borda/wire"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAPIKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "apikeys")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "apikeys.yaml")
+	writeKeys := func(keys string) {
+		assert.NoError(t, ioutil.WriteFile(file, []byte(keys), 0644))
+	}
+	writeKeys(`
+keys:
+  secret-a:
+    id: a
+    names: [combined]
+    rate: 1
+    burst: 2
+  secret-b:
+    id: b
+`)
+	keys, err := LoadAPIKeys(file)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	var saved []*Measurement
+	h := &Handler{
+		Save: func(m *Measurement) error {
+			saved = append(saved, m)
+			return nil
+		},
+		APIKeys: keys,
+	}
+	post := func(secret string, measurements ...*Measurement) *httptest.ResponseRecorder {
+		b, _ := json.Marshal(measurements)
+		return postMeasurements(h, ContentTypeJSON, b, map[string]string{wire.APIKeyHeader: secret})
+	}
+	other := &Measurement{Name: "other", Values: good.Values}
+	spoofed := &Measurement{Name: "combined", Values: good.Values, Dimensions: map[string]interface{}{APIKeyDimension: "b"}}
+
+	assert.Equal(t, http.StatusUnauthorized, post("").Code)
+	assert.Equal(t, http.StatusUnauthorized, post("unknown", good).Code)
+
+	resp := post("secret-a", spoofed, other)
+	assert.Equal(t, http.StatusCreated, resp.Code)
+	result := &Result{}
+	if assert.NoError(t, json.NewDecoder(resp.Body).Decode(result)) {
+		assert.Equal(t, 1, result.Accepted)
+		assert.Equal(t, []*Rejection{{1, "Name not allowed for API key"}}, result.Rejected)
+	}
+	if assert.Len(t, saved, 1) {
+		assert.Equal(t, "a", saved[0].Dimensions[APIKeyDimension], "Key identity should override dimension submitted by client")
+	}
+
+	resp = post("secret-a", good)
+	assert.Equal(t, http.StatusTooManyRequests, resp.Code, "Rate quota should have been exceeded")
+	assert.NotEmpty(t, resp.Header().Get("Retry-After"))
+	assert.Equal(t, http.StatusCreated, post("secret-b", other, other, other).Code, "Key without rate should be unlimited")
+
+	writeKeys(`
+keys:
+  secret-c:
+    id: c
+`)
+	assert.NoError(t, keys.Reload())
+	assert.Equal(t, http.StatusUnauthorized, post("secret-b", good).Code, "Revoked key should be refused")
+	assert.Equal(t, http.StatusCreated, post("secret-c", good).Code)
+
+	writeKeys("keys:\n  secret-c:\n    id: c\n  secret-d: {}\n")
+	err = keys.Reload()
+	if assert.Error(t, err, "Key without id should fail") {
+		assert.Contains(t, err.Error(), "API key 2 in")
+		assert.NotContains(t, err.Error(), "secret", "Error shouldn't reveal the secret")
+	}
+	assert.Equal(t, http.StatusCreated, post("secret-c", good).Code, "Should have kept keys after failed reload")
+
+	writeKeys("keys:\n  \"\":\n    id: empty\n")
+	assert.Error(t, keys.Reload(), "Empty key should fail")
+	assert.Equal(t, http.StatusUnauthorized, post("").Code, "Empty key shouldn't authenticate")
+}
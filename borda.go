@@ -1,8 +1,10 @@
 package borda
 
 import (
+	"encoding/json"
 	"time"
 
+	"github.com/getlantern/borda/wire"
 	"github.com/getlantern/golog"
 )
 
@@ -34,6 +36,56 @@ type Measurement struct {
 	//            "cpu_user": 36.6,
 	//            "connected_to_internet": true }
 	Dimensions map[string]interface{} `json:"dimensions,omitempty"`
+
+	// Histograms contains histogram values, which are submitted in the values
+	// alongside numeric values and are stored as one value per quantile.
+	Histograms map[string]*Histogram `json:"-"`
+
+	// valuesErr records why values failed to decode, so that the measurement
+	// can be rejected on its own without failing the rest of its batch.
+	valuesErr error
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface. Values may either be
+// plain numbers, which are treated as sums, or typed values like {"type":
+// "max", "v": 3} (see decodeValue). Values that are invalid don't fail
+// decoding, instead the measurement is rejected when it's processed.
+func (m *Measurement) UnmarshalJSON(b []byte) error {
+	type measurement Measurement
+	aux := &struct {
+		*measurement
+		Values map[string]json.RawMessage `json:"values,omitempty"`
+	}{measurement: (*measurement)(m)}
+	err := json.Unmarshal(b, aux)
+	if err != nil {
+		return err
+	}
+
+	m.Values = nil
+	m.Histograms = nil
+	m.valuesErr = nil
+	if aux.Values == nil {
+		return nil
+	}
+	m.Values = make(map[string]float64, len(aux.Values))
+	for key, raw := range aux.Values {
+		err = m.decodeValue(key, raw)
+		if err != nil {
+			m.valuesErr = err
+			return nil
+		}
+	}
+	return nil
+}
+
+// expandHistograms stores the given quantiles of each histogram as values.
+func (m *Measurement) expandHistograms(quantiles []float64) {
+	for key, h := range m.Histograms {
+		for _, q := range quantiles {
+			m.Values[wire.QuantileField(key, q)] = h.Quantile(q)
+		}
+	}
+	m.Histograms = nil
 }
 
 // SaveFunc is a function that saves a measurement
@@ -39,8 +39,28 @@ var (
 	oauthClientSecret        = flag.String("oauthclientsecret", "da57775e1c2d7956a50e81501491eabe48d45c14", "secret id to use for oauth client to connect to GitHub")
 	gitHubOrg                = flag.String("githuborg", "getlantern", "the GitHug org against which web users are authenticated")
 	ispdb                    = flag.String("ispdb", "", "In order to enable ISP functions, point this to a maxmind ISP database file")
+	streamsFile              = flag.String("streams", "streams.yaml", "Optionally specify the path to a YAML file that routes measurements to streams by name, defaults to routing everything to 'inbound'")
+	pipelineFile             = flag.String("pipeline", "pipeline.yaml", "Optionally specify the path to a YAML file configuring stages (drop, rename, derive, tee) through which measurements pass before being saved")
 	aliasesFile              = flag.String("aliases", "aliases.props", "Optionally specify the path to a file containing expression aliases in the form alias=template(%v,%v) with one alias per line")
 	sampleRate               = flag.Float64("samplerate", 0.2, "The sample rate (0.2 = 20%)")
+	maxPast                  = flag.Duration("maxpast", borda.DefaultMaxPast, "How far in the past (after correcting for clock skew) measurement timestamps may be, defaults to 24 hours")
+	maxFuture                = flag.Duration("maxfuture", borda.DefaultMaxFuture, "How far in the future (after correcting for clock skew) measurement timestamps may be, defaults to 5 minutes")
+	clampTimestamps          = flag.Bool("clamptimestamps", false, "Set to true to clamp out of range timestamps rather than discarding the measurements")
+	queueSize                = flag.Int("queuesize", 100000, "The number of measurements to queue for saving asynchronously, set to 0 to save synchronously while handling requests. Queue stats are available at /debug/vars on the pprofaddr.")
+	queueWorkers             = flag.Int("queueworkers", borda.DefaultQueueWorkers, "The number of goroutines saving measurements from the queue")
+	apiKeysFile              = flag.String("apikeys", "", "Optionally specify the path to a YAML file of API keys, which clients are then required to send in the X-Borda-Api-Key header")
+	apiKeysReloadInterval    = flag.Duration("apikeysreloadinterval", 1*time.Minute, "How frequently to check the API keys file for changes")
+	ipRequestRate            = flag.Float64("iprequestrate", 0, "Optionally limit the requests per second from each client IP, 0 means unlimited")
+	ipMeasurementRate        = flag.Float64("ipmeasurementrate", 0, "Optionally limit the measurements per second from each client IP, 0 means unlimited")
+	trustCDNHeaders          = flag.Bool("trustcdnheaders", false, "Set to true to take client IPs for rate limiting from the Cf-Connecting-Ip and Cloudfront-Viewer-Address headers, only safe if measurements can only be submitted through a CDN")
+	apiKeyRequestRate        = flag.Float64("apikeyrequestrate", 0, "Optionally limit the requests per second with each API key, 0 means unlimited")
+	apiKeyMeasurementRate    = flag.Float64("apikeymeasurementrate", 0, "Optionally limit the measurements per second with each API key, 0 means unlimited")
+	maxBodyBytes             = flag.Int64("maxbodybytes", borda.DefaultMaxBodyBytes, "The maximum size of request bodies as received, defaults to 10 MB")
+	maxBatchSize             = flag.Int("maxbatchsize", borda.DefaultMaxBatchSize, "The maximum number of measurements per request, capped at queuesize when queueing")
+	maxValues                = flag.Int("maxvalues", borda.DefaultMaxValues, "The maximum number of values per measurement")
+	maxDimensions            = flag.Int("maxdimensions", borda.DefaultMaxDimensions, "The maximum number of dimensions per measurement")
+	maxKeyLength             = flag.Int("maxkeylength", borda.DefaultMaxKeyLength, "The maximum length of measurement names and value and dimension keys")
+	maxValueLength           = flag.Int("maxvaluelength", borda.DefaultMaxValueLength, "The maximum length of string dimension values")
 	password                 = flag.String("password", "GCKKjRHYxfeDaNhPmJnUs9cY3ewaHb", "The authentication token for accessing reports")
 	maxWALSize               = flag.Int("maxwalsize", 1024*1024*1024, "Maximum size of WAL segments on disk. Defaults to 1 GB.")
 	walCompressionSize       = flag.Int("walcompressionsize", 30*1024*1024, "Size above which to start compressing WAL segments with snappy. Defaults to 30 MB.")
@@ -89,10 +109,19 @@ func main() {
 		}
 	}
 
-	s, db, err := borda.TDBSave(*dbdir, "schema.yaml", *aliasesFile, *ispdb, redisClient, *redisCacheSize, *maxWALSize, *walCompressionSize, *numPartitions, *clusterQueryConcurrency, *maxMemory)
+	streams, err := borda.LoadStreams(*streamsFile)
+	if err != nil {
+		log.Fatalf("Unable to load stream routing: %v", err)
+	}
+
+	s, db, err := borda.TDBSave(*dbdir, "schema.yaml", *aliasesFile, *ispdb, redisClient, *redisCacheSize, *maxWALSize, *walCompressionSize, *numPartitions, *clusterQueryConcurrency, *maxMemory, streams)
 	if err != nil {
 		log.Fatalf("Unable to initialize tdb: %v", err)
 	}
+	s, err = borda.LoadPipeline(*pipelineFile, s)
+	if err != nil {
+		log.Fatalf("Unable to load pipeline: %v", err)
+	}
 
 	m := autocert.Manager{
 		Prompt: autocert.AcceptTOS,
@@ -144,7 +173,34 @@ func main() {
 
 	log.Debugf("Sampling %f percent of inbound data", *sampleRate*100)
 
-	h := &borda.Handler{Save: s, SampleRate: *sampleRate}
+	var apiKeys *borda.APIKeys
+	if *apiKeysFile != "" {
+		apiKeys, err = borda.LoadAPIKeys(*apiKeysFile)
+		if err != nil {
+			log.Fatalf("Unable to load API keys: %v", err)
+		}
+		go apiKeys.ReloadPeriodically(*apiKeysReloadInterval)
+	}
+
+	h := &borda.Handler{
+		Save:            s,
+		SampleRate:      *sampleRate,
+		MaxPast:         *maxPast,
+		MaxFuture:       *maxFuture,
+		ClampTimestamps: *clampTimestamps,
+		MaxBodyBytes:    *maxBodyBytes,
+		MaxBatchSize:    *maxBatchSize,
+		MaxValues:       *maxValues,
+		MaxDimensions:   *maxDimensions,
+		MaxKeyLength:    *maxKeyLength,
+		MaxValueLength:  *maxValueLength,
+		QueueSize:       *queueSize,
+		QueueWorkers:    *queueWorkers,
+		APIKeys:         apiKeys,
+		IPRateLimit:     rateLimit(*ipRequestRate, *ipMeasurementRate),
+		TrustCDNHeaders: *trustCDNHeaders,
+		APIKeyRateLimit: rateLimit(*apiKeyRequestRate, *apiKeyMeasurementRate),
+	}
 	go h.Report()
 	router := mux.NewRouter()
 	router.Use(borda.ForceCDN(*httpsServerName))
@@ -212,3 +268,15 @@ func getSessionTicketKey() [32]byte {
 	copy(key[:], keySlice)
 	return key
 }
+
+// rateLimit returns a RateLimit for the given rates, or nil if neither rate is
+// limited.
+func rateLimit(requestsPerSecond float64, measurementsPerSecond float64) *borda.RateLimit {
+	if requestsPerSecond <= 0 && measurementsPerSecond <= 0 {
+		return nil
+	}
+	return &borda.RateLimit{
+		RequestsPerSecond:     requestsPerSecond,
+		MeasurementsPerSecond: measurementsPerSecond,
+	}
+}
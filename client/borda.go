@@ -1,17 +1,25 @@
 package client
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/dustin/go-humanize"
+	"github.com/getlantern/borda/routing"
+	"github.com/getlantern/borda/wire"
 	"github.com/getlantern/errors"
 	"github.com/getlantern/golog"
 	"github.com/getlantern/ops"
@@ -22,9 +30,28 @@ import (
 var (
 	log = golog.LoggerFor("borda.client")
 
-	bordaURL = "https://borda.lantern.io/measurements"
-
 	bufferPool = bpool.NewBufferPool(100)
+
+	// ErrClosed is returned by Submitters after the Client has been closed.
+	ErrClosed = errors.New("Borda client is closed")
+)
+
+const (
+	// DefaultURL is the default URL to which measurements are sent via HTTP.
+	DefaultURL = "https://borda.lantern.io/measurements"
+
+	// DefaultRPCAddr is the address of borda.lantern.io's gRPC endpoint.
+	DefaultRPCAddr = "borda.lantern.io:17712"
+
+	defaultCompressionThreshold = 1024
+
+	defaultMaxBufferSize = 1000
+
+	// estimatedValueSize and estimatedMeasurementOverhead are used to estimate
+	// the encoded size of buffered measurements, covering the value's name and
+	// number and the measurement's timestamp and JSON syntax respectively.
+	estimatedValueSize           = 32
+	estimatedMeasurementOverhead = 64
 )
 
 // Measurement represents a measurement at a point in time.
@@ -53,6 +80,10 @@ type Measurement struct {
 	Dimensions json.RawMessage `json:"dimensions,omitempty"`
 
 	dimensions map[string]interface{}
+
+	// seq records when the measurement was last updated, for evicting the
+	// least recently updated measurement.
+	seq uint64
 }
 
 // Options provides configuration options for borda clients
@@ -60,33 +91,180 @@ type Options struct {
 	// BatchInterval specifies how frequent to report to borda
 	BatchInterval time.Duration
 
+	// URL is the URL to which measurements are POSTed when reporting via HTTP.
+	// Defaults to DefaultURL.
+	URL string
+
+	// RPCAddr is the address of borda's gRPC endpoint (e.g.
+	// DefaultRPCAddr). If specified and no RPCClient is given, the client dials
+	// this address and reports via gRPC, falling back to HTTP.
+	RPCAddr string
+
+	// TLSServerName optionally overrides the server name used to verify the
+	// server's certificate, defaulting to the host of URL or RPCAddr.
+	TLSServerName string
+
+	// RootCAs optionally specifies the certificate authorities used to verify
+	// the server's certificate, defaulting to the system's.
+	RootCAs *x509.CertPool
+
+	// APIKey, if specified, is sent with batches submitted via HTTP to
+	// authenticate with borda.
+	APIKey string
+
 	// HTTP Client used to report to Borda
 	HTTPClient *http.Client
 
-	// RPC Client used to report to Borda
+	// RPC Client used to report to Borda. If both an RPCClient and an HTTPClient
+	// are specified, RPC is preferred and HTTP is used as a fallback whenever
+	// sending with RPC fails.
 	RPCClient rpc.Client
 
+	// Transports optionally specifies custom transports to use instead of the
+	// built-in RPC and HTTP ones, in order of preference.
+	Transports []Transport
+
+	// ProbeInterval is how often to try the preferred transport (e.g. RPC) again
+	// after having fallen back to a less preferred one (e.g. HTTP). Defaults to
+	// 15 minutes.
+	ProbeInterval time.Duration
+
+	// CompressionThreshold is the size in bytes of the JSON encoded batch above
+	// which batches sent via HTTP are gzip compressed. Defaults to 1 KB, set to
+	// a negative value to disable compression.
+	CompressionThreshold int
+
+	// NDJSON causes batches sent via HTTP to be encoded as newline-delimited
+	// JSON, which the server decodes and saves one measurement at a time.
+	NDJSON bool
+
+	// SpoolDir optionally specifies a directory in which batches that failed to
+	// send are stored. Spooled batches are replayed in order, with exponential
+	// backoff, on subsequent flushes, including after the process restarts.
+	SpoolDir string
+
+	// MaxSpoolBytes caps the total size of spooled batches, discarding the
+	// oldest ones first. Defaults to 10 MB.
+	MaxSpoolBytes int64
+
+	// MaxSpoolAge is how long to keep spooled batches before discarding them.
+	// Defaults to 24 hours.
+	MaxSpoolAge time.Duration
+
+	// BatchJitter adds a random delay of up to this duration to each
+	// BatchInterval so that many clients don't report in lockstep.
+	BatchJitter time.Duration
+
+	// Retry configures retrying of failed batch submissions. By default, batches
+	// are not retried.
+	Retry *RetryPolicy
+
+	// Streams maps measurement names to the zenodb streams into which they're
+	// inserted when reporting with RPC. Keys may be exact names or wildcard
+	// patterns as understood by path.Match (e.g. "proxy_*"). Exact names take
+	// precedence over patterns and longer patterns over shorter ones.
+	Streams map[string]string
+
+	// DefaultStream is the stream used for measurements that don't match any of
+	// Streams, defaults to "inbound".
+	DefaultStream string
+
+	// FlushThreshold, if positive, triggers an early flush once the number of
+	// buffered measurements across all submitters reaches it.
+	FlushThreshold int
+
+	// FlushThresholdBytes, if positive, triggers an early flush once the
+	// estimated encoded size of the buffered measurements reaches it.
+	FlushThresholdBytes int
+
+	// Dimensions are added to every measurement submitted by this client's
+	// submitters, e.g. the app version and OS. Dimensions of the submitter
+	// and of the individual measurements take precedence.
+	Dimensions map[string]interface{}
+
+	// ReportStats, if true, makes the client report its own Stats (as counts
+	// since the previous batch) with each batch as a borda_client measurement.
+	ReportStats bool
+
 	// BeforeSubmit is an optional callback that gets called before submitting a
 	// batch to borda. The callback should not modify the values and dimensions.
 	BeforeSubmit func(name string, ts time.Time, values map[string]Val, dimensionsJSON []byte)
 }
 
 // Submitter is a functon that submits measurements to borda. If the measurement
-// was successfully queued for submission, this returns nil.
+// was successfully queued for submission, this returns nil. Once the Client has
+// been closed, this returns ErrClosed.
 type Submitter func(values map[string]Val, dimensions map[string]interface{}) error
 
+// SubmitterOptions configures a Submitter created with
+// ReducingSubmitterWithOptions.
+type SubmitterOptions struct {
+	// MaxBufferSize specifies the maximum number of distinct measurements to
+	// buffer within the BatchInterval. Defaults to 1000.
+	MaxBufferSize int
+
+	// OverflowPolicy determines what happens to measurements with new
+	// dimensions once the buffer is full. Defaults to DropNew.
+	OverflowPolicy OverflowPolicy
+
+	// Dimensions are added to every measurement submitted by this submitter,
+	// taking precedence over the client's Dimensions. Dimensions of the
+	// individual measurements take precedence over these.
+	Dimensions map[string]interface{}
+
+	// MaxDimensionValues, if positive, limits how many distinct values each
+	// dimension may take between flushes. Further values are replaced by
+	// DimensionPlaceholder, which keeps dimensions like request IDs from
+	// blowing up the buffer.
+	MaxDimensionValues int
+
+	// DimensionLimits sets the limit for specific dimensions, overriding
+	// MaxDimensionValues. A limit of 0 disables the limit for that dimension.
+	DimensionLimits map[string]int
+
+	// DimensionPlaceholder replaces values of dimensions that exceeded their
+	// limit. Defaults to DefaultDimensionPlaceholder.
+	DimensionPlaceholder string
+
+	// OnCardinalityExceeded, if specified, is called (asynchronously) the
+	// first time between flushes that a dimension exceeds its limit.
+	OnCardinalityExceeded func(name string, dimension string, limit int)
+
+	// internal marks submitters used by the client itself, which aren't
+	// counted in Stats.
+	internal bool
+}
+
 type submitter func(key string, ts time.Time, values map[string]Val, dimensions map[string]interface{}, jsonDimensions []byte) error
 
 // Client is a client that submits measurements to the borda server.
 type Client struct {
-	hc           *http.Client
-	rc           rpc.Client
-	options      *Options
-	buffers      map[int]map[string]*Measurement
-	submitters   map[int]submitter
-	nextBufferID int
-	bytesSent    int
-	mx           sync.Mutex
+	hc              *http.Client
+	rc              rpc.Client
+	transports      []Transport
+	activeTransport int
+	lastProbe       time.Time
+	ownsRPCClient   bool
+	closed          bool
+	stop            chan struct{}
+	stopped         chan struct{}
+	periodicCtx     context.Context
+	cancelPeriodic  context.CancelFunc
+	flushRequests   chan struct{}
+	options         *Options
+	buffers         map[int]map[string]*Measurement
+	submitters      map[int]submitter
+	nextBufferID    int
+	numBuffered     int
+	bytesBuffered   int
+	seq             uint64
+	overflow        submitter
+	lastFlush       time.Time
+	stats           *stats
+	statsSubmitter  submitter
+	streams         *routing.Table
+	spool           *spool
+	mx              sync.Mutex
 }
 
 // NewClient creates a new borda client.
@@ -98,27 +276,85 @@ func NewClient(opts *Options) *Client {
 		log.Debugf("BatchInterval has to be greater than zero, defaulting to 5 minutes")
 		opts.BatchInterval = 5 * time.Minute
 	}
-	if opts.HTTPClient == nil && opts.RPCClient == nil {
+	if opts.URL == "" {
+		opts.URL = DefaultURL
+	}
+	clientSessionCache := tls.NewLRUClientSessionCache(100)
+	if opts.HTTPClient == nil && opts.RPCClient == nil && len(opts.Transports) == 0 {
 		// Default to HTTPClient
 		opts.HTTPClient = &http.Client{
 			Transport: &http.Transport{
 				TLSClientConfig: &tls.Config{
-					ClientSessionCache: tls.NewLRUClientSessionCache(100),
+					ServerName:         opts.TLSServerName,
+					RootCAs:            opts.RootCAs,
+					ClientSessionCache: clientSessionCache,
 				},
 			},
 		}
 	}
+	ownsRPCClient := false
+	if opts.RPCClient == nil && opts.RPCAddr != "" && len(opts.Transports) == 0 {
+		rc, err := dialRPC(opts, clientSessionCache)
+		if err != nil {
+			log.Errorf("Unable to dial borda at %v, will not use gRPC: %v", opts.RPCAddr, err)
+		} else {
+			log.Debugf("Using gRPC to communicate with borda at %v", opts.RPCAddr)
+			opts.RPCClient = rc
+			ownsRPCClient = true
+		}
+	}
+	if opts.ProbeInterval <= 0 {
+		opts.ProbeInterval = defaultProbeInterval
+	}
+	opts.Retry = opts.Retry.withDefaults()
+	if opts.CompressionThreshold == 0 {
+		opts.CompressionThreshold = defaultCompressionThreshold
+	}
+	if opts.DefaultStream == "" {
+		opts.DefaultStream = routing.DefaultStream
+	}
 	if opts.BeforeSubmit == nil {
 		opts.BeforeSubmit = func(name string, ts time.Time, values map[string]Val, dimensionsJSON []byte) {
 		}
 	}
 
+	periodicCtx, cancelPeriodic := context.WithCancel(context.Background())
 	b := &Client{
-		hc:         opts.HTTPClient,
-		rc:         opts.RPCClient,
-		options:    opts,
-		buffers:    make(map[int]map[string]*Measurement),
-		submitters: make(map[int]submitter),
+		hc:             opts.HTTPClient,
+		rc:             opts.RPCClient,
+		ownsRPCClient:  ownsRPCClient,
+		options:        opts,
+		buffers:        make(map[int]map[string]*Measurement),
+		submitters:     make(map[int]submitter),
+		lastFlush:      time.Now(),
+		stats:          &stats{},
+		stop:           make(chan struct{}),
+		stopped:        make(chan struct{}),
+		flushRequests:  make(chan struct{}, 1),
+		periodicCtx:    periodicCtx,
+		cancelPeriodic: cancelPeriodic,
+	}
+	if opts.SpoolDir != "" {
+		var err error
+		b.spool, err = newSpool(opts.SpoolDir, opts.MaxSpoolBytes, opts.MaxSpoolAge, opts.BatchInterval)
+		if err != nil {
+			log.Errorf("Unable to spool, failed batches will be discarded: %v", err)
+		}
+	}
+	b.transports = opts.Transports
+	if len(b.transports) == 0 {
+		if b.rc != nil {
+			b.transports = append(b.transports, &rpcTransport{b})
+		}
+		if b.hc != nil {
+			b.transports = append(b.transports, &httpTransport{b})
+		}
+	}
+	var err error
+	b.streams, err = routing.New(opts.DefaultStream, opts.Streams)
+	if err != nil {
+		log.Errorf("Invalid stream routes, routing everything to %v: %v", opts.DefaultStream, err)
+		b.streams, _ = routing.New(opts.DefaultStream, nil)
 	}
 
 	go b.sendPeriodically()
@@ -127,21 +363,39 @@ func NewClient(opts *Options) *Client {
 
 // DefaultClient creates a new Client that connects to borda.lantern.io
 // using gRPC if possible, or falling back to HTTPS if it can't dial out with
-// gRPC.
+// gRPC or if sending with gRPC fails later on.
 func DefaultClient(batchInterval time.Duration, maxBufferSize int) *Client {
 	log.Debugf("Creating borda client that submits every %v", batchInterval)
 
 	opts := &Options{
 		BatchInterval: batchInterval,
+		URL:           DefaultURL,
+		RPCAddr:       DefaultRPCAddr,
+		BatchJitter:   batchInterval / 10,
+		Retry: &RetryPolicy{
+			MaxAttempts: 3,
+		},
 	}
 
-	clientSessionCache := tls.NewLRUClientSessionCache(10000)
+	return NewClient(opts)
+}
+
+func dialRPC(opts *Options, clientSessionCache tls.ClientSessionCache) (rpc.Client, error) {
+	serverName := opts.TLSServerName
+	if serverName == "" {
+		host, _, err := net.SplitHostPort(opts.RPCAddr)
+		if err != nil {
+			return nil, errors.New("Invalid RPCAddr %v: %v", opts.RPCAddr, err)
+		}
+		serverName = host
+	}
 	clientTLSConfig := &tls.Config{
-		ServerName:         "borda.lantern.io",
+		ServerName:         serverName,
+		RootCAs:            opts.RootCAs,
 		ClientSessionCache: clientSessionCache,
 	}
 
-	rc, err := rpc.Dial("borda.lantern.io:17712", &rpc.ClientOpts{
+	return rpc.Dial(opts.RPCAddr, &rpc.ClientOpts{
 		Dialer: func(addr string, timeout time.Duration) (net.Conn, error) {
 			log.Debug("Dialing borda with gRPC")
 			conn, dialErr := net.DialTimeout("tcp", addr, timeout)
@@ -157,14 +411,6 @@ func DefaultClient(batchInterval time.Duration, maxBufferSize int) *Client {
 			return tlsConn, handshakeErr
 		},
 	})
-	if err != nil {
-		log.Errorf("Unable to dial borda, will not use gRPC: %v", err)
-	} else {
-		log.Debug("Using gRPC to communicate with borda")
-		opts.RPCClient = rc
-	}
-
-	return NewClient(opts)
 }
 
 // EnableOpsReporting registers a reporter with the ops package that reports op
@@ -181,7 +427,7 @@ func (c *Client) EnableOpsReporting(name string, maxBufferSize int) {
 		}
 
 		reportErr := reportToBorda(values, ctx)
-		if reportErr != nil {
+		if reportErr != nil && reportErr != ErrClosed {
 			log.Errorf("Error reporting error to borda: %v", reportErr)
 		}
 	})
@@ -192,12 +438,66 @@ func (c *Client) EnableOpsReporting(name string, maxBufferSize int) {
 // maxBufferSize specifies the maximum number of distinct measurements to buffer
 // within the BatchInterval. Anything past this is discarded.
 func (c *Client) ReducingSubmitter(name string, maxBufferSize int) Submitter {
+	return c.ReducingSubmitterWithOptions(name, &SubmitterOptions{MaxBufferSize: maxBufferSize})
+}
+
+// ReducingSubmitterWithOptions is like ReducingSubmitter but allows configuring
+// the submitter with SubmitterOptions.
+func (c *Client) ReducingSubmitterWithOptions(name string, opts *SubmitterOptions) Submitter {
+	c.mx.Lock()
+	submitter := c.newSubmitter(name, opts)
+	c.mx.Unlock()
+
+	return func(values map[string]Val, dimensions map[string]interface{}) error {
+		// Convert metrics to values
+		for dim, val := range dimensions {
+			metric, ok := val.(Val)
+			if ok {
+				delete(dimensions, dim)
+				values[dim] = metric
+			}
+		}
+
+		jsonDimensions, encodeErr := json.Marshal(dimensions)
+		if encodeErr != nil {
+			return errors.New("Unable to marshal dimensions: %v", encodeErr)
+		}
+		key := string(jsonDimensions)
+		ts := time.Now()
+		c.mx.Lock()
+		if c.closed {
+			c.mx.Unlock()
+			return ErrClosed
+		}
+		atomic.AddInt64(&c.stats.submitted, 1)
+		err := submitter(key, ts, values, dimensions, jsonDimensions)
+		exceedsThreshold := c.exceedsFlushThreshold()
+		c.mx.Unlock()
+		if exceedsThreshold {
+			c.requestFlush()
+		}
+		return err
+	}
+}
+
+// newSubmitter creates a submitter that reduces measurements into its own
+// buffer. Callers must hold the client's lock, both when calling this and when
+// calling the returned submitter.
+func (c *Client) newSubmitter(name string, opts *SubmitterOptions) submitter {
+	if opts == nil {
+		opts = &SubmitterOptions{}
+	}
+	maxBufferSize := opts.MaxBufferSize
 	if maxBufferSize <= 0 {
-		log.Debugf("maxBufferSize has to be greater than zero, defaulting to 1000")
-		maxBufferSize = 1000
+		log.Debugf("maxBufferSize has to be greater than zero, defaulting to %d", defaultMaxBufferSize)
+		maxBufferSize = defaultMaxBufferSize
 	}
-	c.mx.Lock()
-	defer c.mx.Unlock()
+	policy := opts.OverflowPolicy
+	// Static dimensions are the same for every measurement, so they're left
+	// out of the reduction key and only merged in when buffering a measurement
+	// with new dimensions.
+	staticDimensions := mergeDimensions(c.options.Dimensions, opts.Dimensions)
+	guard := newCardinalityGuard(name, opts)
 	bufferID := c.nextBufferID
 	c.nextBufferID++
 	submitter := func(key string, ts time.Time, values map[string]Val, dimensions map[string]interface{}, jsonDimensions []byte) error {
@@ -206,66 +506,184 @@ func (c *Client) ReducingSubmitter(name string, maxBufferSize int) Submitter {
 			// Lazily initialize buffer
 			buffer = make(map[string]*Measurement)
 			c.buffers[bufferID] = buffer
+			if guard != nil {
+				guard.reset()
+			}
 		}
+		if guard != nil {
+			var replaced bool
+			dimensions, replaced = guard.apply(dimensions)
+			if replaced {
+				var encodeErr error
+				jsonDimensions, encodeErr = json.Marshal(dimensions)
+				if encodeErr != nil {
+					return errors.New("Unable to marshal dimensions: %v", encodeErr)
+				}
+				key = string(jsonDimensions)
+			}
+		}
+		c.seq++
 		existing, found := buffer[key]
+		if !found && len(buffer) >= maxBufferSize {
+			switch policy {
+			case EvictLRU:
+				c.bytesBuffered -= estimatedSize(evictLRU(buffer))
+				c.numBuffered--
+				c.recordOverflow(name, policy, "evicted")
+			case FoldOther:
+				key, dimensions, jsonDimensions = otherKey, otherDimensions(), []byte(otherKey)
+				existing, found = buffer[key]
+				c.recordOverflow(name, policy, "folded")
+			default:
+				c.recordOverflow(name, policy, "dropped")
+				return errors.New("Exceeded max buffer size, discarding measurement")
+			}
+		}
 		if found {
+			if !opts.internal {
+				atomic.AddInt64(&c.stats.merged, 1)
+			}
+			// Merging may add values, which grows the measurement
+			sizeBefore := estimatedSize(existing)
 			for key, value := range values {
-				existing.Values[key] = value.Merge(existing.Values[key])
+				existing.Values[key] = mergeBuffered(existing.Values[key], value)
 			}
+			c.bytesBuffered += estimatedSize(existing) - sizeBefore
 			if ts.After(existing.Ts) {
 				existing.Ts = ts
 			}
-		} else if len(buffer) == maxBufferSize {
-			return errors.New("Exceeded max buffer size, discarding measurement")
+			existing.seq = c.seq
 		} else {
-			buffer[key] = &Measurement{
+			if len(staticDimensions) > 0 {
+				dimensions = mergeDimensions(staticDimensions, dimensions)
+				var encodeErr error
+				jsonDimensions, encodeErr = json.Marshal(dimensions)
+				if encodeErr != nil {
+					return errors.New("Unable to marshal dimensions: %v", encodeErr)
+				}
+			}
+			ownBuffered(values)
+			m := &Measurement{
 				Name:       name,
 				Ts:         ts,
 				Values:     values,
 				Dimensions: jsonDimensions,
 				dimensions: dimensions,
+				seq:        c.seq,
 			}
+			buffer[key] = m
+			c.numBuffered++
+			c.bytesBuffered += estimatedSize(m)
 		}
 		return nil
 	}
 	c.submitters[bufferID] = submitter
+	return submitter
+}
 
-	return func(values map[string]Val, dimensions map[string]interface{}) error {
-		// Convert metrics to values
-		for dim, val := range dimensions {
-			metric, ok := val.(Val)
-			if ok {
-				delete(dimensions, dim)
-				values[dim] = metric
-			}
-		}
+// mergeDimensions returns a new map containing the dimensions from base and
+// overrides, with overrides taking precedence.
+func mergeDimensions(base map[string]interface{}, overrides map[string]interface{}) map[string]interface{} {
+	merged := make(map[string]interface{}, len(base)+len(overrides))
+	for dim, val := range base {
+		merged[dim] = val
+	}
+	for dim, val := range overrides {
+		merged[dim] = val
+	}
+	return merged
+}
 
-		jsonDimensions, encodeErr := json.Marshal(dimensions)
-		if encodeErr != nil {
-			return errors.New("Unable to marshal dimensions: %v", encodeErr)
+func (c *Client) sendPeriodically() {
+	defer close(c.stopped)
+	log.Debugf("Reporting to Borda every %v (plus up to %v jitter)", c.options.BatchInterval, c.options.BatchJitter)
+	for {
+		timer := time.NewTimer(jittered(c.options.BatchInterval, c.options.BatchJitter))
+		select {
+		case <-c.stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+			c.flush(c.periodicCtx)
+		case <-c.flushRequests:
+			timer.Stop()
+			log.Debug("Flushing early because buffered measurements exceed threshold")
+			c.flush(c.periodicCtx)
 		}
-		key := string(jsonDimensions)
-		ts := time.Now()
-		c.mx.Lock()
-		err := submitter(key, ts, values, dimensions, jsonDimensions)
-		c.mx.Unlock()
-		return err
 	}
 }
 
-func (c *Client) sendPeriodically() {
-	log.Debugf("Reporting to Borda every %v", c.options.BatchInterval)
-	for range time.NewTicker(c.options.BatchInterval).C {
-		c.Flush()
+// exceedsFlushThreshold checks whether the buffered measurements exceed the
+// configured flush thresholds. Callers must hold the client's lock.
+func (c *Client) exceedsFlushThreshold() bool {
+	return (c.options.FlushThreshold > 0 && c.numBuffered >= c.options.FlushThreshold) ||
+		(c.options.FlushThresholdBytes > 0 && c.bytesBuffered >= c.options.FlushThresholdBytes)
+}
+
+// requestFlush asks the reporting goroutine to flush asynchronously. Requests
+// made while a flush is already pending are coalesced into that flush.
+func (c *Client) requestFlush() {
+	select {
+	case c.flushRequests <- struct{}{}:
+	default:
+		// flush already pending
+	}
+}
+
+// estimatedSize estimates the size of the measurement once encoded, without
+// actually encoding it.
+func estimatedSize(m *Measurement) int {
+	return len(m.Name) + len(m.Dimensions) + len(m.Values)*estimatedValueSize + estimatedMeasurementOverhead
+}
+
+// Close stops periodic reporting and flushes any currently buffered data,
+// giving up once ctx is done. After Close, Submitters return ErrClosed.
+func (c *Client) Close(ctx context.Context) error {
+	c.mx.Lock()
+	if c.closed {
+		c.mx.Unlock()
+		return nil
 	}
+	c.closed = true
+	c.mx.Unlock()
+
+	defer func() {
+		if c.ownsRPCClient {
+			c.rc.Close()
+		}
+	}()
+	// Abort any periodic flush that's still running if ctx expires while
+	// waiting for it
+	defer c.cancelPeriodic()
+
+	close(c.stop)
+	select {
+	case <-c.stopped:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	return c.flush(ctx)
 }
 
 // Flush flushes any currently buffered data.
 func (c *Client) Flush() {
+	c.flush(context.Background())
+}
+
+func (c *Client) flush(ctx context.Context) error {
 	c.mx.Lock()
+	if c.options.ReportStats {
+		c.reportStats()
+	}
 	currentBuffers := c.buffers
 	// Clear out buffers
 	c.buffers = make(map[int]map[string]*Measurement, len(c.buffers))
+	c.numBuffered = 0
+	c.bytesBuffered = 0
+	now := time.Now()
+	period := now.Sub(c.lastFlush)
+	c.lastFlush = now
 	c.mx.Unlock()
 
 	// Count measurements
@@ -273,43 +691,77 @@ func (c *Client) Flush() {
 	for _, buffer := range currentBuffers {
 		numMeasurements += len(buffer)
 	}
-	if numMeasurements == 0 {
+	if numMeasurements == 0 && c.spool == nil {
 		log.Debug("Nothing to report")
-		return
+		return nil
 	}
 
 	// Make batch
-	batch := make(map[string][]*Measurement)
+	batch := make(Batch)
 	for _, buffer := range currentBuffers {
 		for _, m := range buffer {
+			for key, value := range m.Values {
+				if p, ok := value.(periodic); ok {
+					m.Values[key] = p.withPeriod(period)
+				}
+			}
 			name := m.Name
 			batch[name] = append(batch[name], m)
+			c.options.BeforeSubmit(m.Name, m.Ts, m.Values, m.Dimensions)
 		}
 	}
 
+	if c.spool != nil {
+		return c.flushSpooled(ctx, batch, numMeasurements)
+	}
+
 	log.Debugf("Attempting to report %d measurements to Borda", numMeasurements)
-	numInserted, err := c.doSendBatch(batch)
+	numInserted, err := c.sendBatch(ctx, batch)
 	log.Debugf("Sent %d measurements", numInserted)
 	if err != nil {
 		log.Errorf("Error sending batch: %v", err)
 	}
+	return err
 }
 
-func (c *Client) doSendBatch(batch map[string][]*Measurement) (int, error) {
-	for _, measurements := range batch {
-		for _, m := range measurements {
-			c.options.BeforeSubmit(m.Name, m.Ts, m.Values, m.Dimensions)
+// flushSpooled replays any spooled batches before sending the current batch.
+// If the spool can't be fully replayed, or the current batch fails to send with
+// an error that's worth retrying, the current batch is spooled too so that
+// batches are always sent in order.
+func (c *Client) flushSpooled(ctx context.Context, batch Batch, numMeasurements int) error {
+	c.spool.mx.Lock()
+	defer c.spool.mx.Unlock()
+
+	drained := c.spool.replay(func(spooled Batch) (int, error) {
+		return c.doSendBatch(ctx, spooled)
+	})
+	if numMeasurements == 0 {
+		log.Debug("Nothing to report")
+		return nil
+	}
+	if drained {
+		log.Debugf("Attempting to report %d measurements to Borda", numMeasurements)
+		numInserted, err := c.sendBatch(ctx, batch)
+		log.Debugf("Sent %d measurements", numInserted)
+		if err == nil {
+			return nil
+		}
+		unsent := toSpool(batch, numInserted, err)
+		if unsent == nil {
+			log.Errorf("Error sending batch, discarding: %v", err)
+			return err
 		}
+		log.Errorf("Error sending batch, spooling unsent measurements: %v", err)
+		batch = unsent
 	}
-	if c.rc != nil {
-		log.Debug("Sending batch with RPC")
-		return c.doSendBatchRPC(batch)
+	err := c.spool.write(batch)
+	if err != nil {
+		log.Errorf("Unable to spool batch, discarding: %v", err)
 	}
-	log.Debug("Sending batch with HTTP")
-	return c.doSendBatchHTTP(batch)
+	return err
 }
 
-func (c *Client) doSendBatchHTTP(batchByName map[string][]*Measurement) (int, error) {
+func (c *Client) doSendBatchHTTP(ctx context.Context, batchByName Batch) (int, error) {
 	numInserted := 0
 	var batch []*Measurement
 	for _, measurements := range batchByName {
@@ -318,65 +770,213 @@ func (c *Client) doSendBatchHTTP(batchByName map[string][]*Measurement) (int, er
 	}
 	buf := bufferPool.Get()
 	defer bufferPool.Put(buf)
-	err := json.NewEncoder(buf).Encode(batch)
-	batchBytes := buf.Len()
+	var err error
+	contentType := "application/json"
+	enc := json.NewEncoder(buf)
+	if c.options.NDJSON {
+		contentType = "application/x-ndjson"
+		for _, m := range batch {
+			err = enc.Encode(m)
+			if err != nil {
+				break
+			}
+		}
+	} else {
+		err = enc.Encode(batch)
+	}
 	if err != nil {
 		return 0, log.Errorf("Unable to encode measurements for reporting: %v", err)
 	}
 
-	req, decErr := http.NewRequest(http.MethodPost, bordaURL, buf)
-	if decErr != nil {
+	body := buf
+	contentEncoding := ""
+	if threshold := c.options.CompressionThreshold; threshold > 0 && buf.Len() > threshold {
+		compressed := bufferPool.Get()
+		defer bufferPool.Put(compressed)
+		gzw := gzip.NewWriter(compressed)
+		_, err = gzw.Write(buf.Bytes())
+		if err == nil {
+			err = gzw.Close()
+		}
+		if err != nil {
+			return 0, log.Errorf("Unable to compress measurements for reporting: %v", err)
+		}
+		log.Debugf("Compressed batch from %v to %v (ratio %.2f)", humanize.Bytes(uint64(buf.Len())), humanize.Bytes(uint64(compressed.Len())), float64(buf.Len())/float64(compressed.Len()))
+		body = compressed
+		contentEncoding = "gzip"
+	}
+	return c.retry(ctx, func() (int, error) {
+		return c.doPostBatch(ctx, body.Bytes(), contentType, contentEncoding, numInserted)
+	})
+}
+
+// doPostBatch posts an encoded batch of numMeasurements measurements to borda.
+// Network errors and retryable status codes result in a *retryableError.
+func (c *Client) doPostBatch(ctx context.Context, body []byte, contentType string, contentEncoding string, numMeasurements int) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, c.options.URL, bytes.NewReader(body))
+	if err != nil {
 		return 0, err
 	}
-	req.Header.Set("Content-Type", "application/json")
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", contentType)
+	if contentEncoding != "" {
+		req.Header.Set("Content-Encoding", contentEncoding)
+	}
+	req.Header.Set(wire.SentAtHeader, time.Now().Format(time.RFC3339Nano))
+	if c.options.APIKey != "" {
+		req.Header.Set(wire.APIKeyHeader, c.options.APIKey)
+	}
 
 	resp, err := c.hc.Do(req)
 	if err != nil {
-		return 0, err
+		return 0, &retryableError{error: err}
 	}
 	defer resp.Body.Close()
 
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, fmt.Errorf("Borda replied with %d, but response couldn't be read: %v", resp.StatusCode, err)
+	}
+	result := &httpResult{}
+	if len(respBody) == 0 || json.Unmarshal(respBody, result) != nil {
+		result = nil
+	}
+
 	switch resp.StatusCode {
 	case 201:
-		c.bytesSent += batchBytes
-		log.Debugf("Sent %v to borda, cumulatively %v", humanize.Bytes(uint64(batchBytes)), humanize.Bytes(uint64(c.bytesSent)))
-		return numInserted, nil
+		bytesSent := atomic.AddInt64(&c.stats.bytes, int64(len(body)))
+		log.Debugf("Sent %v to borda, cumulatively %v", humanize.Bytes(uint64(len(body))), humanize.Bytes(uint64(bytesSent)))
+		if result == nil {
+			// Server didn't report results (e.g. because the batch wasn't sampled)
+			return numMeasurements, nil
+		}
+		if len(result.Rejected) > 0 || len(result.Failed) > 0 {
+			log.Debugf("Borda rejected %d and failed to save %d measurements: %v", len(result.Rejected), len(result.Failed), result.reasons())
+		}
+		return result.Accepted, nil
 	case 400:
-		errorMsg, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			return 0, fmt.Errorf("Borda replied with 400, but error message couldn't be read: %v", err)
+		if result != nil {
+			return 0, fmt.Errorf("Borda rejected all measurements: %v", result.reasons())
 		}
-		return 0, fmt.Errorf("Borda replied with the error: %v", string(errorMsg))
+		return 0, fmt.Errorf("Borda replied with the error: %v", string(respBody))
 	default:
-		return 0, fmt.Errorf("Borda replied with error %d", resp.StatusCode)
+		err = fmt.Errorf("Borda replied with error %d", resp.StatusCode)
+		if c.options.Retry.isRetryable(resp.StatusCode) {
+			return 0, &retryableError{err, retryAfter(resp)}
+		}
+		return 0, err
 	}
 }
 
-func (c *Client) doSendBatchRPC(batch map[string][]*Measurement) (int, error) {
-	numInserted := 0
-	for _, measurements := range batch {
-		// TODO: right now we send everything to "inbound", might be nice to
-		// separate streams where we can.
-		inserter, err := c.rc.NewInserter(context.Background(), "inbound")
-		if err != nil {
-			return numInserted, fmt.Errorf("Unable to get inserter: %v", err)
+// httpResult is the response from the borda server to a batch submitted via
+// HTTP.
+type httpResult struct {
+	Accepted int `json:"accepted"`
+	Rejected []struct {
+		Index  int    `json:"index"`
+		Reason string `json:"reason"`
+	} `json:"rejected"`
+	Failed []int `json:"failed"`
+}
+
+// reasons summarizes the distinct reasons for which measurements were
+// rejected.
+func (r *httpResult) reasons() string {
+	counts := make(map[string]int)
+	var reasons []string
+	for _, rejection := range r.Rejected {
+		if counts[rejection.Reason] == 0 {
+			reasons = append(reasons, rejection.Reason)
 		}
-		for _, m := range measurements {
-			err = inserter.Insert(m.Ts, m.dimensions, func(cb func(string, interface{})) {
-				for key, val := range m.Values {
-					cb(key, val.Get())
-				}
-			})
-			if err != nil {
-				inserter.Close()
-				return numInserted, fmt.Errorf("Error inserting: %v", err)
+		counts[rejection.Reason]++
+	}
+	summary := make([]string, 0, len(reasons))
+	for _, reason := range reasons {
+		summary = append(summary, fmt.Sprintf("%v (%d)", reason, counts[reason]))
+	}
+	return strings.Join(summary, ", ")
+}
+
+// doSendBatchRPC inserts the batch one name at a time. If inserting a name
+// fails, the names that weren't attempted yet are reported as unsent, along
+// with the failed name if none of its measurements were inserted.
+func (c *Client) doSendBatchRPC(ctx context.Context, batch Batch) (Result, error) {
+	names := make([]string, 0, len(batch))
+	for name := range batch {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	result := Result{}
+	for i, name := range names {
+		measurements := batch[name]
+		n, err := c.retry(ctx, func() (int, error) {
+			return c.doInsertRPC(ctx, name, measurements)
+		})
+		result.Inserted += n
+		if err != nil {
+			result.Unsent = make(Batch)
+			if n == 0 {
+				result.Unsent[name] = measurements
+			}
+			for _, unsent := range names[i+1:] {
+				result.Unsent[unsent] = batch[unsent]
 			}
+			return result, err
 		}
-		report, err := inserter.Close()
+	}
+	return result, nil
+}
+
+// doInsertRPC inserts measurements with the given name using RPC. Errors are
+// retryable unless some measurements may already have been inserted, since
+// retrying would insert those again.
+func (c *Client) doInsertRPC(ctx context.Context, name string, measurements []*Measurement) (int, error) {
+	inserter, err := c.rc.NewInserter(ctx, c.streamFor(name))
+	if err != nil {
+		return 0, &retryableError{error: fmt.Errorf("Unable to get inserter: %v", err)}
+	}
+	return insertRPC(inserter, measurements)
+}
+
+// insertRPC inserts the measurements with the inserter and closes it, returning
+// the number of measurements that the server reported as inserted.
+func insertRPC(inserter rpc.Inserter, measurements []*Measurement) (int, error) {
+	inserted := 0
+	for _, m := range measurements {
+		err := inserter.Insert(m.Ts, m.dimensions, func(cb func(string, interface{})) {
+			for key, val := range m.Values {
+				reportFields(key, val, cb)
+			}
+		})
 		if err != nil {
-			return numInserted, fmt.Errorf("Error closing inserter: %v", err)
+			report, _ := inserter.Close()
+			return insertRPCFailed(report, inserted, fmt.Errorf("Error inserting: %v", err))
 		}
-		numInserted += report.Succeeded
+		inserted++
 	}
-	return numInserted, nil
+	report, err := inserter.Close()
+	if err != nil {
+		return insertRPCFailed(report, inserted, fmt.Errorf("Error closing inserter: %v", err))
+	}
+	return report.Succeeded, nil
+}
+
+// insertRPCFailed reports how many measurements were inserted before err,
+// which is only retryable if none were.
+func insertRPCFailed(report *rpc.InsertReport, inserted int, err error) (int, error) {
+	numInserted := 0
+	if report != nil {
+		numInserted = report.Succeeded
+	}
+	if inserted > 0 || numInserted > 0 {
+		return numInserted, err
+	}
+	return 0, &retryableError{error: err}
+}
+
+// streamFor returns the stream to which measurements with the given name are
+// routed.
+func (c *Client) streamFor(name string) string {
+	return c.streams.StreamFor(name)
 }
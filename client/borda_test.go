@@ -1,8 +1,12 @@
 package client
 
 import (
+	"compress/gzip"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/http/httputil"
@@ -11,6 +15,7 @@ import (
 	"time"
 
 	"github.com/getlantern/eventual"
+	"github.com/getlantern/zenodb/rpc"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -18,12 +23,13 @@ func TestBordaClient(t *testing.T) {
 	submitted := eventual.NewValue()
 	ts := newMockServer(submitted)
 	defer ts.Close()
-	bordaURL = ts.URL
 
 	bc := NewClient(
 		&Options{
+			URL:           ts.URL,
 			BatchInterval: 100 * time.Millisecond,
 		})
+	defer bc.Close(context.Background())
 	assert.NotNil(t, bc)
 	submit := bc.ReducingSubmitter("errors", 5)
 
@@ -73,7 +79,7 @@ func TestBordaClient(t *testing.T) {
 	if assert.Len(t, _ms, 1) {
 		ms := _ms.([]map[string]interface{})
 		assert.EqualValues(t, 1, ms[0]["values"].(map[string]interface{})["success_count"])
-		assert.EqualValues(t, 2, ms[0]["values"].(map[string]interface{})["an_average"])
+		assert.EqualValues(t, map[string]interface{}{"type": "avg", "sum": 2.0, "count": 1.0}, ms[0]["values"].(map[string]interface{})["an_average"])
 	}
 }
 
@@ -88,9 +94,28 @@ func newMockServer(submitted eventual.Value) *httptest.Server {
 			log.Tracef("Mock server received request: %v", string(dump))
 		}
 
-		decoder := json.NewDecoder(r.Body)
+		var body io.Reader = r.Body
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			body, err = gzip.NewReader(r.Body)
+			if err != nil {
+				w.WriteHeader(400)
+				return
+			}
+		}
+		decoder := json.NewDecoder(body)
 		var ms []map[string]interface{}
-		err = decoder.Decode(&ms)
+		if r.Header.Get("Content-Type") == "application/x-ndjson" {
+			for decoder.More() {
+				var m map[string]interface{}
+				err = decoder.Decode(&m)
+				if err != nil {
+					break
+				}
+				ms = append(ms, m)
+			}
+		} else {
+			err = decoder.Decode(&ms)
+		}
 		if err != nil {
 			w.WriteHeader(500)
 			fmt.Fprintf(w, "Error decoding JSON request: %v", err)
@@ -106,3 +131,306 @@ func newMockServer(submitted eventual.Value) *httptest.Server {
 
 	return ts
 }
+
+func TestStreamFor(t *testing.T) {
+	bc := NewClient(&Options{
+		Streams: map[string]string{
+			"proxy_*":       "proxies",
+			"client_errors": "clients",
+		},
+	})
+	defer bc.Close(context.Background())
+	assert.Equal(t, "clients", bc.streamFor("client_errors"))
+	assert.Equal(t, "proxies", bc.streamFor("proxy_bandwidth"))
+	assert.Equal(t, "inbound", bc.streamFor("other"))
+}
+
+func TestCompression(t *testing.T) {
+	submitted := eventual.NewValue()
+	ts := newMockServer(submitted)
+	defer ts.Close()
+
+	bc := NewClient(&Options{
+		URL:                  ts.URL,
+		BatchInterval:        time.Hour,
+		CompressionThreshold: 10,
+	})
+	defer bc.Close(context.Background())
+	submit := bc.ReducingSubmitter("compressed", 100)
+	for i := 0; i < 50; i++ {
+		submit(map[string]Val{"count": Sum(1)}, map[string]interface{}{"i": i})
+	}
+	bc.Flush()
+	_ms, sent := submitted.Get(0)
+	if assert.True(t, sent, "Should have sent compressed measurements") {
+		assert.Len(t, _ms, 50)
+	}
+}
+
+func TestNDJSON(t *testing.T) {
+	submitted := eventual.NewValue()
+	ts := newMockServer(submitted)
+	defer ts.Close()
+
+	bc := NewClient(&Options{
+		URL:           ts.URL,
+		BatchInterval: time.Hour,
+		NDJSON:        true,
+	})
+	defer bc.Close(context.Background())
+	submit := bc.ReducingSubmitter("lines", 100)
+	for i := 0; i < 5; i++ {
+		submit(map[string]Val{"count": Sum(1)}, map[string]interface{}{"i": i})
+	}
+	bc.Flush()
+	_ms, sent := submitted.Get(0)
+	if assert.True(t, sent, "Should have sent newline-delimited measurements") {
+		assert.Len(t, _ms, 5)
+	}
+}
+
+func TestPartialResults(t *testing.T) {
+	status := 201
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		fmt.Fprint(w, `{"accepted": 2, "rejected": [{"index": 1, "reason": "Missing name"}], "failed": [3]}`)
+	}))
+	defer ts.Close()
+
+	bc := NewClient(&Options{BatchInterval: time.Hour, URL: ts.URL})
+	defer bc.Close(context.Background())
+	batch := Batch{"a": {{Name: "a"}, {}, {Name: "a"}, {Name: "a"}}}
+	numInserted, err := bc.doSendBatchHTTP(context.Background(), batch)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, numInserted)
+
+	status = 400
+	numInserted, err = bc.doSendBatchHTTP(context.Background(), batch)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "Missing name (1)")
+	}
+	assert.Equal(t, 0, numInserted)
+}
+
+func TestMultipleEndpoints(t *testing.T) {
+	submittedA := eventual.NewValue()
+	tsA := newMockServer(submittedA)
+	defer tsA.Close()
+	submittedB := eventual.NewValue()
+	tsB := newMockServer(submittedB)
+	defer tsB.Close()
+
+	bcA := NewClient(&Options{BatchInterval: time.Hour, URL: tsA.URL})
+	defer bcA.Close(context.Background())
+	bcB := NewClient(&Options{BatchInterval: time.Hour, URL: tsB.URL})
+	defer bcB.Close(context.Background())
+	bcA.ReducingSubmitter("a", 10)(map[string]Val{"v": Sum(1)}, map[string]interface{}{})
+	bcB.ReducingSubmitter("b", 10)(map[string]Val{"v": Sum(1)}, map[string]interface{}{})
+	bcA.Flush()
+	bcB.Flush()
+
+	msA, _ := submittedA.Get(0)
+	msB, _ := submittedB.Get(0)
+	if assert.Len(t, msA, 1) && assert.Len(t, msB, 1) {
+		assert.Equal(t, "a", msA.([]map[string]interface{})[0]["name"])
+		assert.Equal(t, "b", msB.([]map[string]interface{})[0]["name"])
+	}
+}
+
+func TestClose(t *testing.T) {
+	var received int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&received, 1)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer ts.Close()
+
+	bc := NewClient(&Options{BatchInterval: time.Hour, URL: ts.URL})
+	submit := bc.ReducingSubmitter("closing", 10)
+	assert.NoError(t, submit(map[string]Val{"v": Sum(1)}, map[string]interface{}{}))
+
+	assert.NoError(t, bc.Close(context.Background()))
+	assert.EqualValues(t, 1, atomic.LoadInt32(&received), "Close should have flushed remaining measurements")
+	select {
+	case <-bc.stopped:
+	default:
+		assert.Fail(t, "Periodic reporting should have stopped")
+	}
+	assert.Equal(t, ErrClosed, submit(map[string]Val{"v": Sum(1)}, map[string]interface{}{}))
+	assert.NoError(t, bc.Close(context.Background()), "Closing twice should be fine")
+}
+
+func TestCloseTimeout(t *testing.T) {
+	requestStarted := make(chan bool, 1)
+	requestCanceled := make(chan bool, 1)
+	release := make(chan bool)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The request's context is only canceled after the body has been read
+		io.Copy(ioutil.Discard, r.Body)
+		requestStarted <- true
+		select {
+		case <-r.Context().Done():
+			requestCanceled <- true
+		case <-release:
+		}
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	bc := NewClient(&Options{BatchInterval: time.Hour, URL: ts.URL, FlushThreshold: 1})
+	rc := &mockRPCClient{}
+	bc.rc, bc.ownsRPCClient = rc, true
+	submit := bc.ReducingSubmitter("closing", 10)
+	assert.NoError(t, submit(map[string]Val{"v": Sum(1)}, map[string]interface{}{}))
+	<-requestStarted
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, bc.Close(ctx))
+	select {
+	case <-requestCanceled:
+	case <-time.After(time.Second):
+		assert.Fail(t, "Close should have aborted the periodic flush")
+	}
+	assert.EqualValues(t, 1, atomic.LoadInt32(&rc.closed), "Close should have closed the RPC client it owns")
+}
+
+// mockRPCClient records whether it was closed.
+type mockRPCClient struct {
+	rpc.Client
+	closed int32
+}
+
+func (rc *mockRPCClient) Close() error {
+	atomic.AddInt32(&rc.closed, 1)
+	return nil
+}
+
+func TestOverflowPolicies(t *testing.T) {
+	type submitted struct {
+		name       string
+		count      float64
+		dimensions string
+	}
+
+	run := func(policy OverflowPolicy) (errs int, result []submitted) {
+		bc := NewClient(&Options{
+			BatchInterval: time.Hour,
+			Transports:    []Transport{&mockTransport{"mock", true, &[]string{}}},
+			BeforeSubmit: func(name string, ts time.Time, values map[string]Val, dimensionsJSON []byte) {
+				for _, val := range values {
+					result = append(result, submitted{name, val.Get(), string(dimensionsJSON)})
+				}
+			},
+		})
+		defer bc.Close(context.Background())
+		submit := bc.ReducingSubmitterWithOptions("overflowing", &SubmitterOptions{MaxBufferSize: 2, OverflowPolicy: policy})
+		for _, i := range []int{0, 1, 0, 2, 3} {
+			if submit(map[string]Val{"count": Sum(1)}, map[string]interface{}{"i": i}) != nil {
+				errs++
+			}
+		}
+		bc.Flush()
+		return
+	}
+
+	errs, result := run(DropNew)
+	assert.Equal(t, 2, errs)
+	assert.ElementsMatch(t, []submitted{
+		{"overflowing", 2, `{"i":0}`},
+		{"overflowing", 1, `{"i":1}`},
+		{"borda_overflow", 2, `{"measurement":"overflowing","policy":"drop_new"}`},
+	}, result)
+
+	errs, result = run(EvictLRU)
+	assert.Equal(t, 0, errs)
+	assert.ElementsMatch(t, []submitted{
+		{"overflowing", 1, `{"i":2}`},
+		{"overflowing", 1, `{"i":3}`},
+		{"borda_overflow", 2, `{"measurement":"overflowing","policy":"evict_lru"}`},
+	}, result)
+
+	errs, result = run(FoldOther)
+	assert.Equal(t, 0, errs)
+	assert.ElementsMatch(t, []submitted{
+		{"overflowing", 2, `{"i":0}`},
+		{"overflowing", 1, `{"i":1}`},
+		{"overflowing", 2, `{"__other__":true}`},
+		{"borda_overflow", 2, `{"measurement":"overflowing","policy":"fold_other"}`},
+	}, result)
+}
+
+func TestStaticDimensions(t *testing.T) {
+	var submitted []string
+	bc := NewClient(&Options{
+		BatchInterval: time.Hour,
+		Transports:    []Transport{&mockTransport{"mock", true, &[]string{}}},
+		Dimensions:    map[string]interface{}{"app_version": "1.0", "os": "linux"},
+		BeforeSubmit: func(name string, ts time.Time, values map[string]Val, dimensionsJSON []byte) {
+			submitted = append(submitted, string(dimensionsJSON))
+		},
+	})
+	defer bc.Close(context.Background())
+
+	submit := bc.ReducingSubmitterWithOptions("static", &SubmitterOptions{
+		Dimensions: map[string]interface{}{"os": "windows", "country": "US"},
+	})
+	submit(map[string]Val{"v": Sum(1)}, map[string]interface{}{"country": "DE"})
+	submit(map[string]Val{"v": Sum(1)}, map[string]interface{}{"country": "DE"})
+	submit(map[string]Val{"v": Sum(1)}, map[string]interface{}{})
+	bc.Flush()
+	assert.ElementsMatch(t, []string{
+		`{"app_version":"1.0","country":"DE","os":"windows"}`,
+		`{"app_version":"1.0","country":"US","os":"windows"}`,
+	}, submitted)
+}
+
+func TestFlushThresholds(t *testing.T) {
+	var received int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ms []map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&ms)
+		atomic.AddInt32(&received, int32(len(ms)))
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer ts.Close()
+
+	waitForReceived := func(expected int32) bool {
+		for i := 0; i < 100; i++ {
+			if atomic.LoadInt32(&received) >= expected {
+				return true
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return false
+	}
+
+	bc := NewClient(&Options{BatchInterval: time.Hour, URL: ts.URL, FlushThreshold: 3})
+	defer bc.Close(context.Background())
+	submit := bc.ReducingSubmitter("threshold", 100)
+	for i := 0; i < 2; i++ {
+		submit(map[string]Val{"v": Sum(1)}, map[string]interface{}{"i": i})
+	}
+	time.Sleep(50 * time.Millisecond)
+	assert.EqualValues(t, 0, atomic.LoadInt32(&received), "Shouldn't have flushed below threshold")
+	submit(map[string]Val{"v": Sum(1)}, map[string]interface{}{"i": 2})
+	assert.True(t, waitForReceived(3), "Should have flushed once threshold was reached")
+
+	atomic.StoreInt32(&received, 0)
+	bc2 := NewClient(&Options{BatchInterval: time.Hour, URL: ts.URL, FlushThresholdBytes: 1024, CompressionThreshold: -1})
+	defer bc2.Close(context.Background())
+	submit = bc2.ReducingSubmitter("threshold_bytes", 100)
+	for i := 0; i < 20; i++ {
+		submit(map[string]Val{"v": Sum(1)}, map[string]interface{}{"i": i})
+	}
+	assert.True(t, waitForReceived(1), "Should have flushed once byte threshold was reached")
+
+	atomic.StoreInt32(&received, 0)
+	bc3 := NewClient(&Options{BatchInterval: time.Hour, URL: ts.URL, FlushThresholdBytes: 1024, CompressionThreshold: -1})
+	defer bc3.Close(context.Background())
+	submit = bc3.ReducingSubmitter("threshold_bytes_merged", 100)
+	for i := 0; i < 40; i++ {
+		submit(map[string]Val{fmt.Sprintf("v%d", i): Sum(1)}, map[string]interface{}{"i": 0})
+	}
+	assert.True(t, waitForReceived(1), "Should have flushed once values merged into one measurement reached byte threshold")
+}
@@ -2,6 +2,10 @@ package client
 
 import (
 	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/getlantern/borda/wire"
 )
 
 // Val represents a value that can be reduced by a reducing submitter.
@@ -14,6 +18,65 @@ type Val interface {
 	Merge(b Val) Val
 }
 
+// multiField is implemented by values that are reported as several fields when
+// they can't be sent in their compact form (e.g. via RPC).
+type multiField interface {
+	// fields calls cb with the name and value of each field that represents
+	// the value reported under name.
+	fields(name string, cb func(string, interface{}))
+}
+
+// reportFields reports the given value to cb as one or more fields.
+func reportFields(name string, val Val, cb func(string, interface{})) {
+	if mf, ok := val.(multiField); ok {
+		mf.fields(name, cb)
+		return
+	}
+	cb(name, val.Get())
+}
+
+// decodeVal decodes a value from the JSON form in which it's sent to borda,
+// which is either a plain number or an object with a type.
+func decodeVal(b json.RawMessage) (Val, error) {
+	typed := &wire.Value{}
+	if json.Unmarshal(b, typed) != nil {
+		var val float64
+		err := json.Unmarshal(b, &val)
+		if err != nil {
+			return nil, err
+		}
+		return Sum(val), nil
+	}
+	switch typed.Type {
+	case wire.TypeSum, wire.TypeMin, wire.TypeMax, wire.TypeCount, wire.TypeLast:
+		if typed.V == nil {
+			return nil, fmt.Errorf("Missing v for %v value", typed.Type)
+		}
+	}
+	switch typed.Type {
+	case wire.TypeSum:
+		return Sum(*typed.V), nil
+	case wire.TypeMin:
+		return Min(*typed.V), nil
+	case wire.TypeMax:
+		return Max(*typed.V), nil
+	case wire.TypeCount:
+		return Count(*typed.V), nil
+	case wire.TypeLast:
+		return last{*typed.V, typed.Ts}, nil
+	case wire.TypeAvg:
+		return avg{typed.Sum, typed.Count}, nil
+	case wire.TypeRate:
+		return rate{typed.Events, typed.Seconds}, nil
+	case wire.TypeHistogram:
+		h := newHistogram()
+		err := json.Unmarshal(b, h)
+		return h, err
+	default:
+		return nil, fmt.Errorf("Unknown value type %v", typed.Type)
+	}
+}
+
 // Sum is float value that gets reduced by plain addition.
 type Sum float64
 
@@ -46,7 +109,8 @@ func (a Float) Get() float64 {
 	return float64(a)
 }
 
-// Min is a float value that gets reduced by taking the lowest value.
+// Min is a float value that gets reduced by taking the lowest value. borda
+// stores it as <name>__min.
 type Min float64
 
 func (a Min) Merge(b Val) Val {
@@ -65,7 +129,16 @@ func (a Min) Get() float64 {
 	return float64(a)
 }
 
-// Max is a float value that gets reduced by taking the highest value.
+func (a Min) fields(name string, cb func(string, interface{})) {
+	cb(wire.FieldFor(name, wire.TypeMin), a.Get())
+}
+
+func (a Min) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&wire.Typed{Type: wire.TypeMin, V: a.Get()})
+}
+
+// Max is a float value that gets reduced by taking the highest value. borda
+// stores it as <name>__max.
 type Max float64
 
 func (a Max) Merge(b Val) Val {
@@ -84,8 +157,17 @@ func (a Max) Get() float64 {
 	return float64(a)
 }
 
+func (a Max) fields(name string, cb func(string, interface{})) {
+	cb(wire.FieldFor(name, wire.TypeMax), a.Get())
+}
+
+func (a Max) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&wire.Typed{Type: wire.TypeMax, V: a.Get()})
+}
+
 // Avg creates a value that gets reduced by taking the arithmetic mean of the
-// values.
+// values. It's reported as two fields, <name>__sum and <name>__count, from
+// which borda calculates averages with SUM(<name>__sum) / SUM(<name>__count).
 func Avg(val float64) Val {
 	return avg{val, 1}
 }
@@ -117,7 +199,127 @@ func (a avg) Get() float64 {
 	return a[0] / a[1]
 }
 
-// avg is marshalled to JSON as its final float64 value.
+// fields reports the avg as its total and count so that borda can calculate
+// averages weighted across clients.
+func (a avg) fields(name string, cb func(string, interface{})) {
+	cb(name+wire.AvgSumSuffix, a[0])
+	cb(name+wire.AvgCountSuffix, a[1])
+}
+
+// avg is marshalled to JSON as its total and count.
 func (a avg) MarshalJSON() ([]byte, error) {
-	return json.Marshal(a.Get())
+	return json.Marshal(&wire.Avg{Type: wire.TypeAvg, Sum: a[0], Count: a[1]})
+}
+
+// Count is a float value that counts occurrences. Merging it with another Count
+// adds the counts, while merging it with any other value counts that value as a
+// single occurrence.
+type Count float64
+
+func (a Count) Merge(_b Val) Val {
+	if _b == nil {
+		return a
+	}
+	switch b := _b.(type) {
+	case Count:
+		return a + b
+	default:
+		return a + 1
+	}
+}
+
+func (a Count) Get() float64 {
+	return float64(a)
+}
+
+func (a Count) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&wire.Typed{Type: wire.TypeCount, V: a.Get()})
+}
+
+// Last creates a value that gets reduced by keeping the most recently submitted
+// value, like a gauge. borda stores it as <name>__last.
+func Last(val float64) Val {
+	return last{val, time.Now()}
+}
+
+// last holds a value along with the time at which it was submitted so that the
+// most recent value wins regardless of the order in which values are merged.
+type last struct {
+	val float64
+	ts  time.Time
+}
+
+func (a last) Merge(_b Val) Val {
+	b, ok := _b.(last)
+	if ok && b.ts.After(a.ts) {
+		return b
+	}
+	return a
+}
+
+func (a last) Get() float64 {
+	return a.val
+}
+
+func (a last) fields(name string, cb func(string, interface{})) {
+	cb(wire.FieldFor(name, wire.TypeLast), a.val)
+}
+
+func (a last) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&wire.Last{Type: wire.TypeLast, V: a.val, Ts: a.ts})
+}
+
+// periodic is implemented by values that depend on the period over which they
+// were collected, which is only known once they're flushed.
+type periodic interface {
+	// withPeriod returns the value collected over the given period.
+	withPeriod(period time.Duration) Val
+}
+
+// Rate creates a value that counts events and reports them as events per
+// second over the batch interval in which they were submitted. Like Avg, it's
+// reported as <name>__sum (events) and <name>__count (seconds), so that borda
+// calculates rates with SUM(<name>__sum) / SUM(<name>__count).
+func Rate(events float64) Val {
+	return rate{events, 0}
+}
+
+// rate holds the number of events plus the number of seconds over which they
+// occurred. The seconds are set when the batch is flushed.
+type rate [2]float64
+
+func (a rate) Merge(_b Val) Val {
+	if _b == nil {
+		return a
+	}
+	switch b := _b.(type) {
+	case rate:
+		return rate{a[0] + b[0], a[1] + b[1]}
+	default:
+		return rate{a[0] + b.Get(), a[1]}
+	}
+}
+
+// Get returns the events per second, or 0 if the period isn't known yet.
+func (a rate) Get() float64 {
+	if a[1] == 0 {
+		return 0
+	}
+	return a[0] / a[1]
+}
+
+func (a rate) withPeriod(period time.Duration) Val {
+	if a[1] != 0 {
+		return a
+	}
+	return rate{a[0], period.Seconds()}
+}
+
+func (a rate) fields(name string, cb func(string, interface{})) {
+	cb(name+wire.AvgSumSuffix, a[0])
+	cb(name+wire.AvgCountSuffix, a[1])
+}
+
+func (a rate) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&wire.Rate{Type: wire.TypeRate, Events: a[0], Seconds: a[1]})
 }
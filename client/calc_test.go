@@ -1,8 +1,12 @@
 package client
 
 import (
-	"github.com/stretchr/testify/assert"
+	"context"
+	"encoding/json"
 	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
 )
 
 func TestSum(t *testing.T) {
@@ -17,6 +21,75 @@ func TestMax(t *testing.T) {
 	assert.Equal(t, 2.0, Max(-1).Merge(Max(2)).Merge(Max(0)).Merge(nil).Get())
 }
 
+func TestTypedJSON(t *testing.T) {
+	for _, val := range []Val{Sum(3), Count(3), Min(3), Max(3), Last(3), Rate(3).(periodic).withPeriod(time.Minute)} {
+		b, err := json.Marshal(val)
+		if !assert.NoError(t, err) {
+			continue
+		}
+		decoded, err := decodeVal(b)
+		if assert.NoError(t, err) {
+			assert.IsType(t, val, decoded)
+			reencoded, _ := json.Marshal(decoded)
+			assert.JSONEq(t, string(b), string(reencoded))
+		}
+	}
+	decoded, err := decodeVal(json.RawMessage(`{"type": "sum", "v": 3}`))
+	if assert.NoError(t, err) {
+		assert.Equal(t, Sum(3), decoded)
+	}
+
+	fields := make(map[string]interface{})
+	for name, val := range map[string]Val{"a": Sum(1), "b": Min(2), "c": Max(3)} {
+		reportFields(name, val, func(field string, v interface{}) {
+			fields[field] = v
+		})
+	}
+	assert.Equal(t, map[string]interface{}{"a": 1.0, "b__min": 2.0, "c__max": 3.0}, fields)
+}
+
+func TestCount(t *testing.T) {
+	assert.Equal(t, 4.0, Count(1).Merge(Count(2)).Merge(Sum(5)).Merge(nil).Get())
+}
+
+func TestLast(t *testing.T) {
+	older := Last(1)
+	newer := Last(2)
+	assert.Equal(t, 2.0, older.Merge(newer).Get())
+	assert.Equal(t, 2.0, newer.Merge(older).Get())
+	assert.Equal(t, 2.0, newer.Merge(Sum(5)).Merge(nil).Get())
+
+	fields := make(map[string]interface{})
+	reportFields("connections", newer, func(field string, v interface{}) {
+		fields[field] = v
+	})
+	assert.Equal(t, map[string]interface{}{"connections__last": 2.0}, fields)
+}
+
+func TestRate(t *testing.T) {
+	r := Rate(30).Merge(Rate(60)).Merge(Sum(30))
+	assert.Equal(t, 0.0, r.Get(), "Rate without period should be 0")
+	r = r.(periodic).withPeriod(time.Minute)
+	assert.Equal(t, 2.0, r.Get())
+	assert.Equal(t, r, r.(periodic).withPeriod(time.Hour), "Period should only be set once")
+
+	var flushed Val
+	bc := NewClient(&Options{
+		BatchInterval: time.Hour,
+		Transports:    []Transport{&mockTransport{"mock", true, &[]string{}}},
+		BeforeSubmit: func(name string, ts time.Time, values map[string]Val, dimensionsJSON []byte) {
+			flushed = values["requests"]
+		},
+	})
+	defer bc.Close(context.Background())
+	bc.lastFlush = time.Now().Add(-10 * time.Second)
+	bc.ReducingSubmitter("rates", 10)(map[string]Val{"requests": Rate(100)}, map[string]interface{}{})
+	bc.Flush()
+	if assert.NotNil(t, flushed) {
+		assert.InDelta(t, 10, flushed.Get(), 0.1, "Rate should be over the time since the last flush")
+	}
+}
+
 func TestAvg(t *testing.T) {
 	// Note - the subsequent types don't matter
 	a1 := Avg(1).Merge(Sum(2))
@@ -29,3 +102,125 @@ func TestWeightedAvg(t *testing.T) {
 	assert.Equal(t, 2.0, WeightedAvg(2, 5).Get())
 	assert.Equal(t, 0.0, WeightedAvg(2, 0).Merge(WeightedAvg(3, 0)).Merge(nil).Get())
 }
+
+func TestAvgWeightPreserved(t *testing.T) {
+	a := WeightedAvg(2, 5).Merge(Avg(4))
+	fields := make(map[string]interface{})
+	reportFields("latency", a, func(name string, val interface{}) {
+		fields[name] = val
+	})
+	assert.Equal(t, map[string]interface{}{"latency__sum": 14.0, "latency__count": 6.0}, fields)
+
+	b, err := json.Marshal(a)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.JSONEq(t, `{"type": "avg", "sum": 14, "count": 6}`, string(b))
+	decoded, err := decodeVal(b)
+	if assert.NoError(t, err) {
+		assert.Equal(t, a, decoded)
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	a := Histogram()
+	b := Histogram()
+	for i := 1; i <= 1000; i++ {
+		if i%2 == 0 {
+			a = Histogram(float64(i)).Merge(a)
+		} else {
+			b = b.Merge(Sum(float64(i)))
+		}
+	}
+	h := a.Merge(b).Merge(nil).(*histogram)
+	assert.InEpsilon(t, 500, h.Get(), 0.02)
+	assert.InEpsilon(t, 950, h.quantile(0.95), 0.02)
+	assert.InEpsilon(t, 990, h.quantile(0.99), 0.02)
+	assert.EqualValues(t, 1000, h.count)
+
+	assert.Equal(t, 0.0, Histogram().Get())
+	assert.Equal(t, 0.0, Histogram(-5, 0, 5).Get())
+	assert.InEpsilon(t, -5, Histogram(-5, 0, 5).(*histogram).quantile(0), 0.02)
+
+	fields := make(map[string]interface{})
+	reportFields("latency", h, func(name string, val interface{}) {
+		fields[name] = val
+	})
+	assert.Len(t, fields, 3)
+	assert.Contains(t, fields, "latency_p99")
+}
+
+func TestHistogramImmutable(t *testing.T) {
+	h := Histogram(1, 2, 3)
+	merged := h.Merge(h).Merge(Sum(4))
+	assert.EqualValues(t, 7, merged.(*histogram).count)
+	assert.EqualValues(t, 3, h.(*histogram).count, "Merging shouldn't modify the original histogram")
+	assert.Equal(t, Histogram(1, 2, 3), h)
+
+	inconsistent := newHistogram()
+	inconsistent.count = 3
+	assert.Equal(t, 0.0, inconsistent.quantile(0.99), "Histogram without bins shouldn't panic")
+	_, err := decodeVal(json.RawMessage(`{"type": "histogram", "accuracy": 0.01, "pos": [1, -2], "sum": 0}`))
+	assert.Error(t, err, "Negative counts should be rejected")
+	_, err = decodeVal(json.RawMessage(`{"type": "histogram", "accuracy": 0.01, "zeros": -1, "sum": 0}`))
+	assert.Error(t, err, "Negative zeros should be rejected")
+}
+
+func TestBufferedHistogramsMergeInPlace(t *testing.T) {
+	var reported Val
+	bc := NewClient(&Options{
+		BatchInterval: time.Hour,
+		Transports:    []Transport{&mockTransport{"mock", true, &[]string{}}},
+		BeforeSubmit: func(name string, ts time.Time, values map[string]Val, dimensionsJSON []byte) {
+			reported = values["h"]
+		},
+	})
+	defer bc.Close(context.Background())
+
+	first, second := Histogram(1), Histogram(2)
+	submit := bc.ReducingSubmitter("histograms", 10)
+	buffered := func() Val {
+		bc.mx.Lock()
+		defer bc.mx.Unlock()
+		for _, buffer := range bc.buffers {
+			for _, m := range buffer {
+				return m.Values["h"]
+			}
+		}
+		return nil
+	}
+	submit(map[string]Val{"h": first}, map[string]interface{}{})
+	submit(map[string]Val{"h": second}, map[string]interface{}{})
+	merged := buffered()
+	submit(map[string]Val{"h": second}, map[string]interface{}{})
+	assert.True(t, merged == buffered(), "Should have merged into the buffered histogram in place")
+	bc.Flush()
+	if assert.NotNil(t, reported) {
+		assert.EqualValues(t, 3, reported.(*histogram).count)
+	}
+	assert.Equal(t, Histogram(1), first, "Submitted histograms shouldn't be modified")
+	assert.Equal(t, Histogram(2), second, "Submitted histograms shouldn't be modified")
+}
+
+func TestHistogramJSON(t *testing.T) {
+	h := Histogram(-1, 0, 1, 10, 100)
+	b, err := json.Marshal(map[string]Val{"h": h})
+	if !assert.NoError(t, err) {
+		return
+	}
+	var vals map[string]json.RawMessage
+	assert.NoError(t, json.Unmarshal(b, &vals))
+	decoded, err := decodeVal(vals["h"])
+	if assert.NoError(t, err) {
+		assert.Equal(t, h, decoded)
+	}
+
+	decoded, err = decodeVal(json.RawMessage("5"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, Sum(5), decoded)
+	}
+	_, err = decodeVal(json.RawMessage(`{"type": "unknown"}`))
+	assert.Error(t, err)
+	_, err = decodeVal(json.RawMessage(`{"type": "max"}`))
+	assert.Error(t, err, "Missing v should fail")
+}
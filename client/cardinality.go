@@ -0,0 +1,102 @@
+package client
+
+import (
+	"fmt"
+)
+
+const (
+	// DefaultDimensionPlaceholder replaces dimension values beyond a
+	// submitter's cardinality limits.
+	DefaultDimensionPlaceholder = "__other__"
+)
+
+// cardinalityGuard limits how many distinct values each dimension of a
+// submitter's measurements may take between flushes. It's only accessed while
+// holding the client's lock.
+type cardinalityGuard struct {
+	name        string
+	maxValues   int
+	limits      map[string]int
+	placeholder string
+	onExceeded  func(name string, dimension string, limit int)
+	seen        map[string]map[string]bool
+	exceeded    map[string]bool
+}
+
+func newCardinalityGuard(name string, opts *SubmitterOptions) *cardinalityGuard {
+	if opts.MaxDimensionValues <= 0 && len(opts.DimensionLimits) == 0 {
+		return nil
+	}
+	placeholder := opts.DimensionPlaceholder
+	if placeholder == "" {
+		placeholder = DefaultDimensionPlaceholder
+	}
+	g := &cardinalityGuard{
+		name:        name,
+		maxValues:   opts.MaxDimensionValues,
+		limits:      opts.DimensionLimits,
+		placeholder: placeholder,
+		onExceeded:  opts.OnCardinalityExceeded,
+	}
+	g.reset()
+	return g
+}
+
+// reset forgets the values seen so far, which happens whenever the submitter's
+// buffer is flushed.
+func (g *cardinalityGuard) reset() {
+	g.seen = make(map[string]map[string]bool)
+	g.exceeded = make(map[string]bool)
+}
+
+func (g *cardinalityGuard) limitFor(dim string) int {
+	if limit, found := g.limits[dim]; found {
+		return limit
+	}
+	return g.maxValues
+}
+
+// apply returns the given dimensions with values beyond the limits replaced by
+// the placeholder. If nothing needed to be replaced, the original dimensions
+// are returned along with false.
+func (g *cardinalityGuard) apply(dimensions map[string]interface{}) (map[string]interface{}, bool) {
+	var replaced map[string]interface{}
+	for dim, val := range dimensions {
+		limit := g.limitFor(dim)
+		if limit <= 0 {
+			continue
+		}
+		seen := g.seen[dim]
+		if seen == nil {
+			seen = make(map[string]bool)
+			g.seen[dim] = seen
+		}
+		value := fmt.Sprint(val)
+		if seen[value] {
+			continue
+		}
+		if len(seen) < limit {
+			seen[value] = true
+			continue
+		}
+
+		if replaced == nil {
+			replaced = make(map[string]interface{}, len(dimensions))
+			for d, v := range dimensions {
+				replaced[d] = v
+			}
+		}
+		replaced[dim] = g.placeholder
+		if !g.exceeded[dim] {
+			g.exceeded[dim] = true
+			log.Debugf("Dimension %v of %v exceeded %d distinct values, replacing further values with %v", dim, g.name, limit, g.placeholder)
+			if g.onExceeded != nil {
+				go g.onExceeded(g.name, dim, limit)
+			}
+		}
+	}
+	if replaced == nil {
+		return dimensions, false
+	}
+	return replaced, true
+}
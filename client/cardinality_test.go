@@ -0,0 +1,55 @@
+package client
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCardinalityGuard(t *testing.T) {
+	submitted := make(map[string]float64)
+	bc := NewClient(&Options{
+		BatchInterval: time.Hour,
+		Transports:    []Transport{&mockTransport{"mock", true, &[]string{}}},
+		BeforeSubmit: func(name string, ts time.Time, values map[string]Val, dimensionsJSON []byte) {
+			submitted[string(dimensionsJSON)] = values["v"].Get()
+		},
+	})
+	defer bc.Close(context.Background())
+
+	exceeded := make(chan string, 10)
+	submit := bc.ReducingSubmitterWithOptions("cardinality", &SubmitterOptions{
+		MaxDimensionValues: 2,
+		DimensionLimits:    map[string]int{"country": 0},
+		OnCardinalityExceeded: func(name string, dimension string, limit int) {
+			exceeded <- name + "." + dimension
+		},
+	})
+	for i := 0; i < 5; i++ {
+		submit(map[string]Val{"v": Sum(1)}, map[string]interface{}{"request_id": i, "country": i})
+	}
+	bc.Flush()
+	assert.Equal(t, map[string]float64{
+		`{"country":0,"request_id":0}`:           1,
+		`{"country":1,"request_id":1}`:           1,
+		`{"country":2,"request_id":"__other__"}`: 1,
+		`{"country":3,"request_id":"__other__"}`: 1,
+		`{"country":4,"request_id":"__other__"}`: 1,
+	}, submitted)
+
+	select {
+	case dim := <-exceeded:
+		assert.Equal(t, "cardinality.request_id", dim)
+	case <-time.After(time.Second):
+		assert.Fail(t, "Hook should have been called")
+	}
+	assert.Len(t, exceeded, 0, "Hook should only have been called once")
+
+	// Limits apply between flushes
+	submitted = make(map[string]float64)
+	submit(map[string]Val{"v": Sum(1)}, map[string]interface{}{"request_id": 5})
+	bc.Flush()
+	assert.Equal(t, map[string]float64{`{"request_id":5}`: 1}, submitted)
+}
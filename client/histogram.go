@@ -0,0 +1,254 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/getlantern/borda/wire"
+)
+
+const (
+	// histogramAccuracy is the relative accuracy of quantiles calculated from
+	// histograms.
+	histogramAccuracy = 0.01
+)
+
+var (
+	// defaultQuantiles are the quantiles that are reported for histograms when
+	// they can't be sent in their compact form (e.g. via RPC).
+	defaultQuantiles = []float64{0.5, 0.95, 0.99}
+
+	histogramGamma    = (1 + histogramAccuracy) / (1 - histogramAccuracy)
+	histogramLogGamma = math.Log(histogramGamma)
+)
+
+// Histogram creates a value that tracks the distribution of the given values
+// so that quantiles like p95 and p99 can be calculated. It's backed by a
+// DDSketch (https://arxiv.org/abs/1908.10693), which calculates quantiles with a
+// relative accuracy of 1% and which can be merged without losing accuracy.
+//
+// Get returns the median. When reported via HTTP, histograms are sent in their
+// compact form. When reported via RPC, they're sent as one field per quantile,
+// e.g. latency_p50, latency_p95 and latency_p99.
+func Histogram(vals ...float64) Val {
+	h := newHistogram()
+	for _, val := range vals {
+		h.add(val, 1)
+	}
+	return h
+}
+
+// histogram is a DDSketch that maps positive values to bins by the logarithm
+// of their value, negative values to bins by the logarithm of their absolute
+// value and tracks zeros separately.
+type histogram struct {
+	pos   map[int]float64
+	neg   map[int]float64
+	zeros float64
+	count float64
+	sum   float64
+}
+
+func newHistogram() *histogram {
+	return &histogram{
+		pos: make(map[int]float64),
+		neg: make(map[int]float64),
+	}
+}
+
+func histogramIndex(val float64) int {
+	return int(math.Ceil(math.Log(val) / histogramLogGamma))
+}
+
+func histogramValue(index int) float64 {
+	return 2 * math.Pow(histogramGamma, float64(index)) / (histogramGamma + 1)
+}
+
+func (a *histogram) add(val float64, count float64) {
+	switch {
+	case val > 0:
+		a.pos[histogramIndex(val)] += count
+	case val < 0:
+		a.neg[histogramIndex(-val)] += count
+	default:
+		a.zeros += count
+	}
+	a.count += count
+	a.sum += val * count
+}
+
+// clone returns a copy of the histogram that can be modified without affecting
+// the original.
+func (a *histogram) clone() *histogram {
+	result := &histogram{
+		pos:   make(map[int]float64, len(a.pos)),
+		neg:   make(map[int]float64, len(a.neg)),
+		zeros: a.zeros,
+		count: a.count,
+		sum:   a.sum,
+	}
+	for i, count := range a.pos {
+		result.pos[i] = count
+	}
+	for i, count := range a.neg {
+		result.neg[i] = count
+	}
+	return result
+}
+
+// Merge returns a new histogram, leaving both a and b unchanged like other
+// values.
+func (a *histogram) Merge(_b Val) Val {
+	if _b == nil {
+		return a
+	}
+	result := a.clone()
+	result.mergeFrom(_b)
+	return result
+}
+
+// mergeFrom merges b into a, modifying a.
+func (a *histogram) mergeFrom(_b Val) {
+	b, ok := _b.(*histogram)
+	if !ok {
+		a.add(_b.Get(), 1)
+		return
+	}
+	for i, count := range b.pos {
+		a.pos[i] += count
+	}
+	for i, count := range b.neg {
+		a.neg[i] += count
+	}
+	a.zeros += b.zeros
+	a.count += b.count
+	a.sum += b.sum
+}
+
+// ownBuffered replaces the histograms in values with copies that belong to the
+// buffer, so that later submissions can be merged into them in place instead
+// of copying all of their bins on every merge.
+func ownBuffered(values map[string]Val) {
+	for key, value := range values {
+		if h, ok := value.(*histogram); ok {
+			values[key] = h.clone()
+		}
+	}
+}
+
+// mergeBuffered merges a submitted value into a buffered one. Histograms are
+// merged into the buffer's copy in place (see ownBuffered).
+func mergeBuffered(existing Val, value Val) Val {
+	if buffered, ok := existing.(*histogram); ok {
+		if _, ok := value.(*histogram); ok {
+			buffered.mergeFrom(value)
+			return buffered
+		}
+	}
+	return value.Merge(existing)
+}
+
+// Get returns the median.
+func (a *histogram) Get() float64 {
+	return a.quantile(0.5)
+}
+
+// quantile returns the value at the given quantile (between 0 and 1).
+func (a *histogram) quantile(q float64) float64 {
+	if a.count == 0 {
+		return 0
+	}
+	rank := q * (a.count - 1)
+	var cumulative float64
+	negIndexes := sortedIndexes(a.neg)
+	for i := len(negIndexes) - 1; i >= 0; i-- {
+		cumulative += a.neg[negIndexes[i]]
+		if cumulative > rank {
+			return -1 * histogramValue(negIndexes[i])
+		}
+	}
+	cumulative += a.zeros
+	posIndexes := sortedIndexes(a.pos)
+	if cumulative > rank || len(posIndexes) == 0 {
+		return 0
+	}
+	for _, i := range posIndexes {
+		cumulative += a.pos[i]
+		if cumulative > rank {
+			return histogramValue(i)
+		}
+	}
+	return histogramValue(posIndexes[len(posIndexes)-1])
+}
+
+// fields reports the histogram as one field per quantile.
+func (a *histogram) fields(name string, cb func(string, interface{})) {
+	for _, q := range defaultQuantiles {
+		cb(wire.QuantileField(name, q), a.quantile(q))
+	}
+}
+
+func sortedIndexes(bins map[int]float64) []int {
+	indexes := make([]int, 0, len(bins))
+	for i := range bins {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+	return indexes
+}
+
+func flattenBins(bins map[int]float64) []float64 {
+	flattened := make([]float64, 0, len(bins)*2)
+	for _, i := range sortedIndexes(bins) {
+		flattened = append(flattened, float64(i), bins[i])
+	}
+	return flattened
+}
+
+func (a *histogram) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&wire.Histogram{
+		Type:     wire.TypeHistogram,
+		Accuracy: histogramAccuracy,
+		Pos:      flattenBins(a.pos),
+		Neg:      flattenBins(a.neg),
+		Zeros:    a.zeros,
+		Sum:      a.sum,
+	})
+}
+
+func (a *histogram) UnmarshalJSON(b []byte) error {
+	hj := &wire.Histogram{}
+	err := json.Unmarshal(b, hj)
+	if err != nil {
+		return err
+	}
+	if hj.Accuracy != histogramAccuracy {
+		return fmt.Errorf("Unsupported histogram accuracy %v", hj.Accuracy)
+	}
+	*a = *newHistogram()
+	for _, bins := range []struct {
+		flattened []float64
+		bins      map[int]float64
+	}{{hj.Pos, a.pos}, {hj.Neg, a.neg}} {
+		if len(bins.flattened)%2 != 0 {
+			return fmt.Errorf("Histogram bins must be index/count pairs")
+		}
+		for i := 0; i < len(bins.flattened); i += 2 {
+			count := bins.flattened[i+1]
+			if count < 0 {
+				return fmt.Errorf("Histogram bin counts must not be negative")
+			}
+			bins.bins[int(bins.flattened[i])] += count
+			a.count += count
+		}
+	}
+	if hj.Zeros < 0 {
+		return fmt.Errorf("Histogram zeros must not be negative")
+	}
+	a.zeros = hj.Zeros
+	a.count += hj.Zeros
+	a.sum = hj.Sum
+	return nil
+}
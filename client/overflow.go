@@ -0,0 +1,87 @@
+package client
+
+import (
+	"encoding/json"
+	"sync/atomic"
+	"time"
+)
+
+// OverflowPolicy determines what a reducing Submitter does with a measurement
+// whose dimensions aren't buffered yet once its buffer is full. Each overflow is
+// counted and reported with the next batch as a borda_overflow measurement with
+// the dimensions measurement and policy and the values dropped, evicted or
+// folded.
+type OverflowPolicy int
+
+const (
+	// DropNew discards the new measurement.
+	DropNew OverflowPolicy = iota
+
+	// EvictLRU discards the least recently updated measurement in the buffer to
+	// make room for the new one.
+	EvictLRU
+
+	// FoldOther merges the new measurement into a single measurement whose only
+	// dimension is OtherDimension. That measurement doesn't count towards the
+	// buffer size.
+	FoldOther
+)
+
+const (
+	// OtherDimension is the dimension of the measurement into which FoldOther
+	// folds measurements that don't fit in the buffer.
+	OtherDimension = "__other__"
+
+	overflowMeasurement = "borda_overflow"
+	otherKey            = `{"` + OtherDimension + `":true}`
+)
+
+func (p OverflowPolicy) String() string {
+	switch p {
+	case EvictLRU:
+		return "evict_lru"
+	case FoldOther:
+		return "fold_other"
+	default:
+		return "drop_new"
+	}
+}
+
+func otherDimensions() map[string]interface{} {
+	return map[string]interface{}{OtherDimension: true}
+}
+
+// evictLRU removes the least recently updated measurement from the buffer and
+// returns it.
+func evictLRU(buffer map[string]*Measurement) *Measurement {
+	var lruKey string
+	var lru *Measurement
+	for key, m := range buffer {
+		if lru == nil || m.seq < lru.seq {
+			lruKey, lru = key, m
+		}
+	}
+	delete(buffer, lruKey)
+	return lru
+}
+
+// recordOverflow counts an overflow of the named measurement's buffer so that it
+// gets reported with the next batch. Callers must hold the client's lock.
+func (c *Client) recordOverflow(name string, policy OverflowPolicy, outcome string) {
+	log.Debugf("Buffer for %v full, %v measurement", name, outcome)
+	if outcome != "folded" {
+		atomic.AddInt64(&c.stats.dropped, 1)
+	}
+	if name == overflowMeasurement {
+		return
+	}
+	if c.overflow == nil {
+		c.overflow = c.newSubmitter(overflowMeasurement, &SubmitterOptions{internal: true})
+	}
+	dimensions := map[string]interface{}{
+		"measurement": name,
+		"policy":      policy.String(),
+	}
+	jsonDimensions, _ := json.Marshal(dimensions)
+	c.overflow(string(jsonDimensions), time.Now(), map[string]Val{outcome: Sum(1)}, dimensions, jsonDimensions)
+}
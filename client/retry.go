@@ -0,0 +1,139 @@
+package client
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultInitialBackoff = 1 * time.Second
+	defaultMaxBackoff     = 30 * time.Second
+)
+
+var (
+	defaultRetryableStatusCodes = []int{
+		http.StatusTooManyRequests,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout,
+	}
+)
+
+// RetryPolicy configures how the submission of a batch is retried when it
+// fails with a network error or a retryable status code.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of times to try submitting a batch,
+	// including the first attempt. Defaults to 1 (no retries).
+	MaxAttempts int
+
+	// InitialBackoff is how long to wait before the first retry. The wait
+	// doubles after each attempt, with random jitter. Defaults to 1 second.
+	InitialBackoff time.Duration
+
+	// MaxBackoff caps how long to wait between attempts, including waits
+	// requested by the server with Retry-After. Defaults to 30 seconds.
+	MaxBackoff time.Duration
+
+	// RetryableStatusCodes are the HTTP status codes that are retried. Defaults
+	// to 429, 502, 503 and 504.
+	RetryableStatusCodes []int
+}
+
+func (p *RetryPolicy) withDefaults() *RetryPolicy {
+	result := &RetryPolicy{}
+	if p != nil {
+		*result = *p
+	}
+	if result.MaxAttempts <= 0 {
+		result.MaxAttempts = 1
+	}
+	if result.InitialBackoff <= 0 {
+		result.InitialBackoff = defaultInitialBackoff
+	}
+	if result.MaxBackoff <= 0 {
+		result.MaxBackoff = defaultMaxBackoff
+	}
+	if result.RetryableStatusCodes == nil {
+		result.RetryableStatusCodes = defaultRetryableStatusCodes
+	}
+	return result
+}
+
+func (p *RetryPolicy) isRetryable(statusCode int) bool {
+	for _, code := range p.RetryableStatusCodes {
+		if code == statusCode {
+			return true
+		}
+	}
+	return false
+}
+
+// retryableError is an error after which the submission may be retried,
+// optionally after waiting for at least retryAfter.
+type retryableError struct {
+	error
+	retryAfter time.Duration
+}
+
+// retryAfter parses the Retry-After header, which may be either a number of
+// seconds or an HTTP date.
+func retryAfter(resp *http.Response) time.Duration {
+	header := resp.Header.Get("Retry-After")
+	if header == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(header); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(header); err == nil {
+		return date.Sub(time.Now())
+	}
+	return 0
+}
+
+// retry calls send until it succeeds, fails with an error that isn't
+// retryable, the maximum number of attempts is reached or ctx is done.
+func (c *Client) retry(ctx context.Context, send func() (int, error)) (int, error) {
+	policy := c.options.Retry
+	backoff := policy.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		numInserted, err := send()
+		retryable, ok := err.(*retryableError)
+		if !ok || attempt >= policy.MaxAttempts {
+			return numInserted, err
+		}
+
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		if retryable.retryAfter > wait {
+			wait = retryable.retryAfter
+		}
+		if wait > policy.MaxBackoff {
+			wait = policy.MaxBackoff
+		}
+		log.Debugf("Attempt %d of %d failed, retrying in %v: %v", attempt, policy.MaxAttempts, wait, err)
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+			atomic.AddInt64(&c.stats.retried, 1)
+		case <-ctx.Done():
+			timer.Stop()
+			return numInserted, err
+		}
+		backoff *= 2
+		if backoff > policy.MaxBackoff {
+			backoff = policy.MaxBackoff
+		}
+	}
+}
+
+// jittered returns the given interval plus a random amount of up to jitter.
+func jittered(interval time.Duration, jitter time.Duration) time.Duration {
+	if jitter <= 0 {
+		return interval
+	}
+	return interval + time.Duration(rand.Int63n(int64(jitter)))
+}
@@ -0,0 +1,117 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/getlantern/zenodb/rpc"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetry(t *testing.T) {
+	var attempts int32
+	status := http.StatusServiceUnavailable
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) < 3 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(status)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer ts.Close()
+
+	bc := NewClient(&Options{
+		URL:           ts.URL,
+		BatchInterval: time.Hour,
+		Retry: &RetryPolicy{
+			MaxAttempts:    3,
+			InitialBackoff: time.Millisecond,
+		},
+	})
+	defer bc.Close(context.Background())
+	batch := Batch{"a": {{Name: "a"}}}
+	numInserted, err := bc.doSendBatchHTTP(context.Background(), batch)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, numInserted)
+	assert.EqualValues(t, 3, atomic.LoadInt32(&attempts))
+
+	atomic.StoreInt32(&attempts, 0)
+	status = http.StatusBadRequest
+	_, err = bc.doSendBatchHTTP(context.Background(), batch)
+	assert.Error(t, err)
+	assert.EqualValues(t, 1, atomic.LoadInt32(&attempts), "Non-retryable status should not be retried")
+}
+
+func TestRetryAfter(t *testing.T) {
+	resp := &http.Response{Header: make(http.Header)}
+	assert.Equal(t, time.Duration(0), retryAfter(resp))
+	resp.Header.Set("Retry-After", "5")
+	assert.Equal(t, 5*time.Second, retryAfter(resp))
+	resp.Header.Set("Retry-After", time.Now().Add(time.Minute).UTC().Format(http.TimeFormat))
+	assert.InDelta(t, float64(time.Minute), float64(retryAfter(resp)), float64(2*time.Second))
+}
+
+func TestJittered(t *testing.T) {
+	assert.Equal(t, time.Second, jittered(time.Second, 0))
+	for i := 0; i < 100; i++ {
+		d := jittered(time.Second, 100*time.Millisecond)
+		assert.True(t, d >= time.Second && d < 1100*time.Millisecond)
+	}
+}
+
+func TestInsertRPCRetryable(t *testing.T) {
+	measurements := []*Measurement{
+		{Name: "a", Values: map[string]Val{"v": Sum(1)}},
+		{Name: "a", Values: map[string]Val{"v": Sum(2)}},
+	}
+
+	_, err := insertRPC(&mockInserter{failAt: 0}, measurements)
+	assert.IsType(t, &retryableError{}, err, "Failing before inserting anything should be retryable")
+
+	numInserted, err := insertRPC(&mockInserter{failAt: 1, report: &rpc.InsertReport{Succeeded: 1}}, measurements)
+	assert.Error(t, err)
+	assert.False(t, isRetryableError(err), "Failing after inserting should not be retryable")
+	assert.Equal(t, 1, numInserted, "Should report measurements that the server inserted")
+
+	numInserted, err = insertRPC(&mockInserter{failAt: -1, closeErr: errors.New("close failed")}, measurements)
+	assert.Error(t, err)
+	assert.False(t, isRetryableError(err), "Failing to close after inserting should not be retryable")
+	assert.Equal(t, 0, numInserted)
+
+	numInserted, err = insertRPC(&mockInserter{failAt: -1, report: &rpc.InsertReport{Succeeded: 2}}, measurements)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, numInserted)
+}
+
+func isRetryableError(err error) bool {
+	_, ok := err.(*retryableError)
+	return ok
+}
+
+// mockInserter fails the Insert at index failAt (or none if negative) and
+// returns report and closeErr from Close.
+type mockInserter struct {
+	rpc.Inserter
+	failAt   int
+	inserted int
+	report   *rpc.InsertReport
+	closeErr error
+}
+
+func (i *mockInserter) Insert(ts time.Time, dims map[string]interface{}, vals func(func(string, interface{}))) error {
+	if i.inserted == i.failAt {
+		return errors.New("insert failed")
+	}
+	i.inserted++
+	return nil
+}
+
+func (i *mockInserter) Close() (*rpc.InsertReport, error) {
+	return i.report, i.closeErr
+}
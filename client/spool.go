@@ -0,0 +1,257 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getlantern/errors"
+)
+
+const (
+	defaultMaxSpoolBytes = 10 * 1024 * 1024
+	defaultMaxSpoolAge   = 24 * time.Hour
+	maxSpoolBackoff      = time.Hour
+
+	spoolSuffix = ".json"
+)
+
+// spool persists batches that failed to send to disk so that they can be
+// replayed later, including after a restart. Batches are stored one per file,
+// named by the time at which they were spooled so that they sort in order.
+type spool struct {
+	dir         string
+	maxBytes    int64
+	maxAge      time.Duration
+	minBackoff  time.Duration
+	backoff     time.Duration
+	nextAttempt time.Time
+	mx          sync.Mutex
+}
+
+// spooledMeasurement is the on-disk form of a Measurement.
+type spooledMeasurement struct {
+	Name       string                     `json:"name"`
+	Ts         time.Time                  `json:"ts"`
+	Values     map[string]json.RawMessage `json:"values"`
+	Dimensions json.RawMessage            `json:"dimensions"`
+}
+
+func newSpool(dir string, maxBytes int64, maxAge time.Duration, minBackoff time.Duration) (*spool, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, errors.New("Unable to create spool directory %v: %v", dir, err)
+	}
+	if maxBytes <= 0 {
+		maxBytes = defaultMaxSpoolBytes
+	}
+	if maxAge <= 0 {
+		maxAge = defaultMaxSpoolAge
+	}
+	return &spool{
+		dir:        dir,
+		maxBytes:   maxBytes,
+		maxAge:     maxAge,
+		minBackoff: minBackoff,
+	}, nil
+}
+
+// write spools the given batch and then trims the spool to stay within its
+// size and age limits. Callers must hold the spool's lock.
+func (s *spool) write(batch Batch) error {
+	err := s.writeFile(fmt.Sprintf("%020d%v", time.Now().UnixNano(), spoolSuffix), batch)
+	if err != nil {
+		return err
+	}
+	s.trim()
+	return nil
+}
+
+// writeFile writes the batch to the named spool file, atomically replacing
+// any existing file of that name.
+func (s *spool) writeFile(name string, batch Batch) error {
+	var measurements []*Measurement
+	for _, ms := range batch {
+		measurements = append(measurements, ms...)
+	}
+	b, err := json.Marshal(measurements)
+	if err != nil {
+		return errors.New("Unable to encode batch for spooling: %v", err)
+	}
+
+	tmpFile := filepath.Join(s.dir, name+".tmp")
+	err = ioutil.WriteFile(tmpFile, b, 0644)
+	if err != nil {
+		return errors.New("Unable to write spool file: %v", err)
+	}
+	err = os.Rename(tmpFile, filepath.Join(s.dir, name))
+	if err != nil {
+		os.Remove(tmpFile)
+		return errors.New("Unable to finalize spool file: %v", err)
+	}
+	log.Debugf("Spooled %d measurements to %v", len(measurements), name)
+	return nil
+}
+
+// files lists the files of spooled batches, oldest first.
+func (s *spool) files() []os.FileInfo {
+	infos, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		log.Errorf("Unable to list spool directory %v: %v", s.dir, err)
+		return nil
+	}
+	var files []os.FileInfo
+	for _, info := range infos {
+		if !info.IsDir() && strings.HasSuffix(info.Name(), spoolSuffix) {
+			files = append(files, info)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Name() < files[j].Name()
+	})
+	return files
+}
+
+// trim removes spooled batches that are older than maxAge, then removes the
+// oldest batches until the spool fits within maxBytes.
+func (s *spool) trim() {
+	files := s.files()
+	cutoff := time.Now().Add(-1 * s.maxAge)
+	var size int64
+	var kept []os.FileInfo
+	for _, file := range files {
+		if spooledAt(file.Name()).Before(cutoff) {
+			log.Debugf("Discarding expired spool file %v", file.Name())
+			os.Remove(filepath.Join(s.dir, file.Name()))
+			continue
+		}
+		size += file.Size()
+		kept = append(kept, file)
+	}
+	for len(kept) > 0 && size > s.maxBytes {
+		log.Debugf("Spool exceeds %d bytes, discarding %v", s.maxBytes, kept[0].Name())
+		os.Remove(filepath.Join(s.dir, kept[0].Name()))
+		size -= kept[0].Size()
+		kept = kept[1:]
+	}
+}
+
+func spooledAt(name string) time.Time {
+	nanos, err := strconv.ParseInt(strings.TrimSuffix(name, spoolSuffix), 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(0, nanos)
+}
+
+// toSpool returns the part of a batch that failed to send with err that should
+// be kept for later, or nil if none should. Only retryable failures are worth
+// retrying, and after a partial insert only the measurements that are known to
+// be unsent, since sending the others again could insert them twice.
+func toSpool(batch Batch, numInserted int, err error) Batch {
+	if partial, ok := err.(*partialError); ok {
+		batch, err = partial.unsent, partial.error
+	} else if numInserted > 0 {
+		return nil
+	}
+	if _, retryable := err.(*retryableError); !retryable {
+		return nil
+	}
+	return batch
+}
+
+// replay sends spooled batches, oldest first, stopping at the first failure
+// that's worth retrying. Batches that fail otherwise are discarded. After a
+// failure, subsequent replays are skipped with exponential backoff. This
+// returns true if the spool was fully drained. Callers must hold the spool's
+// lock.
+func (s *spool) replay(send func(batch Batch) (int, error)) bool {
+	if time.Now().Before(s.nextAttempt) {
+		log.Debugf("Not replaying spool until %v", s.nextAttempt)
+		return false
+	}
+	s.trim()
+	for _, file := range s.files() {
+		filename := filepath.Join(s.dir, file.Name())
+		batch, err := s.read(filename)
+		if err != nil {
+			log.Errorf("Discarding unreadable spool file %v: %v", file.Name(), err)
+			os.Remove(filename)
+			continue
+		}
+		numInserted, err := send(batch)
+		if err != nil {
+			unsent := toSpool(batch, numInserted, err)
+			if unsent == nil {
+				log.Errorf("Discarding spooled batch %v after inserting %d measurements: %v", file.Name(), numInserted, err)
+				os.Remove(filename)
+				continue
+			}
+			if numInserted > 0 {
+				// Keep only what wasn't inserted
+				writeErr := s.writeFile(file.Name(), unsent)
+				if writeErr != nil {
+					log.Errorf("Unable to update spooled batch %v, discarding: %v", file.Name(), writeErr)
+					os.Remove(filename)
+				}
+			}
+			s.backoff *= 2
+			if s.backoff < s.minBackoff {
+				s.backoff = s.minBackoff
+			}
+			if s.backoff > maxSpoolBackoff {
+				s.backoff = maxSpoolBackoff
+			}
+			s.nextAttempt = time.Now().Add(s.backoff)
+			log.Debugf("Unable to replay spooled batch %v, will retry in %v: %v", file.Name(), s.backoff, err)
+			return false
+		}
+		log.Debugf("Replayed %d spooled measurements from %v", numInserted, file.Name())
+		os.Remove(filename)
+	}
+	s.backoff = 0
+	s.nextAttempt = time.Time{}
+	return true
+}
+
+func (s *spool) read(filename string) (Batch, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var spooled []*spooledMeasurement
+	err = json.Unmarshal(b, &spooled)
+	if err != nil {
+		return nil, err
+	}
+	batch := make(Batch)
+	for _, sm := range spooled {
+		m := &Measurement{
+			Name:       sm.Name,
+			Ts:         sm.Ts,
+			Values:     make(map[string]Val, len(sm.Values)),
+			Dimensions: sm.Dimensions,
+		}
+		for key, value := range sm.Values {
+			m.Values[key], err = decodeVal(value)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if len(sm.Dimensions) > 0 {
+			err = json.Unmarshal(sm.Dimensions, &m.dimensions)
+			if err != nil {
+				return nil, err
+			}
+		}
+		batch[m.Name] = append(batch[m.Name], m)
+	}
+	return batch, nil
+}
@@ -0,0 +1,151 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSpool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	var up int32
+	var received []int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&up) == 0 {
+			w.WriteHeader(503)
+			return
+		}
+		var ms []struct {
+			Values map[string]float64
+		}
+		decodeErr := json.NewDecoder(r.Body).Decode(&ms)
+		if !assert.NoError(t, decodeErr) {
+			return
+		}
+		for _, m := range ms {
+			received = append(received, int(m.Values["i"]))
+		}
+		w.WriteHeader(201)
+	}))
+	defer ts.Close()
+
+	newClient := func() (*Client, Submitter) {
+		bc := NewClient(&Options{
+			URL:           ts.URL,
+			BatchInterval: time.Hour,
+			SpoolDir:      dir,
+		})
+		return bc, bc.ReducingSubmitter("spooled", 100)
+	}
+
+	bc, submit := newClient()
+	submit(map[string]Val{"i": Sum(1)}, map[string]interface{}{})
+	bc.Flush()
+	submit(map[string]Val{"i": Sum(2)}, map[string]interface{}{})
+	bc.Flush()
+	assert.Len(t, bc.spool.files(), 2, "Failed batches should have been spooled")
+
+	// Simulate restart with server back up
+	assert.NoError(t, bc.Close(context.Background()))
+	atomic.StoreInt32(&up, 1)
+	bc, submit = newClient()
+	defer bc.Close(context.Background())
+	submit(map[string]Val{"i": Sum(3)}, map[string]interface{}{})
+	bc.Flush()
+	assert.Equal(t, []int{1, 2, 3}, received, "Spooled batches should have been replayed in order")
+	assert.Empty(t, bc.spool.files())
+}
+
+func TestSpoolLimits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := newSpool(dir, 1, time.Hour, time.Minute)
+	if !assert.NoError(t, err) {
+		return
+	}
+	batch := Batch{"a": {{Name: "a", Values: map[string]Val{"v": Sum(1)}}}}
+	assert.NoError(t, s.write(batch))
+	assert.Len(t, s.files(), 0, "Batch exceeding max bytes should have been discarded")
+
+	s.maxBytes = defaultMaxSpoolBytes
+	assert.NoError(t, s.write(batch))
+	assert.Len(t, s.files(), 1)
+	s.maxAge = -1 * time.Hour
+	s.trim()
+	assert.Len(t, s.files(), 0, "Expired batch should have been discarded")
+}
+
+func TestSpoolDiscardsUnretryable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	var status int32 = 400
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+	}))
+	defer ts.Close()
+
+	bc := NewClient(&Options{
+		URL:           ts.URL,
+		BatchInterval: time.Hour,
+		SpoolDir:      dir,
+		Retry:         &RetryPolicy{MaxAttempts: 1},
+	})
+	defer bc.Close(context.Background())
+	submit := bc.ReducingSubmitter("spooled", 100)
+	submit(map[string]Val{"i": Sum(1)}, map[string]interface{}{})
+	bc.Flush()
+	assert.Empty(t, bc.spool.files(), "Batch that failed permanently should not have been spooled")
+
+	atomic.StoreInt32(&status, 503)
+	submit(map[string]Val{"i": Sum(2)}, map[string]interface{}{})
+	bc.Flush()
+	assert.Len(t, bc.spool.files(), 1, "Batch that failed with retryable error should have been spooled")
+
+	bc.spool.mx.Lock()
+	defer bc.spool.mx.Unlock()
+	drained := bc.spool.replay(func(batch Batch) (int, error) {
+		return 1, &retryableError{error: errors.New("failed after inserting")}
+	})
+	assert.True(t, drained)
+	assert.Empty(t, bc.spool.files(), "Partially inserted batch should have been discarded")
+
+	assert.NoError(t, bc.spool.write(Batch{
+		"a": {{Name: "a", Values: map[string]Val{"v": Sum(1)}}},
+		"b": {{Name: "b", Values: map[string]Val{"v": Sum(2)}}},
+	}))
+	drained = bc.spool.replay(func(batch Batch) (int, error) {
+		return 1, &partialError{&retryableError{error: errors.New("failed partway")}, Batch{"b": batch["b"]}}
+	})
+	assert.False(t, drained)
+	files := bc.spool.files()
+	if assert.Len(t, files, 1, "Unsent part of batch should have been kept") {
+		batch, err := bc.spool.read(filepath.Join(dir, files[0].Name()))
+		if assert.NoError(t, err) {
+			assert.Len(t, batch, 1)
+			assert.Contains(t, batch, "b")
+		}
+	}
+}
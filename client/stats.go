@@ -0,0 +1,147 @@
+package client
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	clientMeasurement = "borda_client"
+)
+
+// Stats describes what a Client has done since it was created.
+type Stats struct {
+	// Submitted is the number of measurements passed to reducing submitters.
+	Submitted int64
+
+	// Merged is the number of submitted measurements that were reduced into an
+	// already buffered measurement.
+	Merged int64
+
+	// Dropped is the number of measurements that were discarded or evicted
+	// because a submitter's buffer was full.
+	Dropped int64
+
+	// Sent is the number of measurements that borda accepted.
+	Sent int64
+
+	// Failed is the number of measurements in batches that failed to send or
+	// that borda rejected. Batches that are replayed from the spool are counted
+	// each time they fail.
+	Failed int64
+
+	// Retried is the number of times that sending a batch was retried.
+	Retried int64
+
+	// Bytes is the number of bytes sent to borda via HTTP.
+	Bytes int64
+
+	// LastError is the last error encountered while sending a batch, if any.
+	LastError error
+
+	// LastErrorAt is when LastError happened.
+	LastErrorAt time.Time
+}
+
+// stats holds the counters behind Stats. It's allocated separately so that its
+// 64 bit fields are aligned for atomic access.
+type stats struct {
+	submitted   int64
+	merged      int64
+	dropped     int64
+	sent        int64
+	failed      int64
+	retried     int64
+	bytes       int64
+	lastError   error
+	lastErrorAt time.Time
+	reported    Stats
+	mx          sync.Mutex
+}
+
+// Stats returns a snapshot of the client's counters.
+func (c *Client) Stats() Stats {
+	s := c.stats
+	s.mx.Lock()
+	lastError, lastErrorAt := s.lastError, s.lastErrorAt
+	s.mx.Unlock()
+	return Stats{
+		Submitted:   atomic.LoadInt64(&s.submitted),
+		Merged:      atomic.LoadInt64(&s.merged),
+		Dropped:     atomic.LoadInt64(&s.dropped),
+		Sent:        atomic.LoadInt64(&s.sent),
+		Failed:      atomic.LoadInt64(&s.failed),
+		Retried:     atomic.LoadInt64(&s.retried),
+		Bytes:       atomic.LoadInt64(&s.bytes),
+		LastError:   lastError,
+		LastErrorAt: lastErrorAt,
+	}
+}
+
+// recordSend counts the outcome of sending the given batch.
+func (s *stats) recordSend(batch Batch, numInserted int, err error) {
+	numMeasurements := 0
+	for _, measurements := range batch {
+		numMeasurements += len(measurements)
+	}
+	atomic.AddInt64(&s.sent, int64(numInserted))
+	if numMeasurements > numInserted {
+		atomic.AddInt64(&s.failed, int64(numMeasurements-numInserted))
+	}
+	if err != nil {
+		s.mx.Lock()
+		s.lastError = err
+		s.lastErrorAt = time.Now()
+		s.mx.Unlock()
+	}
+}
+
+// reportStats submits the change in the client's counters since they were last
+// reported as a borda_client measurement. Callers must hold the client's lock.
+func (c *Client) reportStats() {
+	if c.statsSubmitter == nil {
+		c.statsSubmitter = c.newSubmitter(clientMeasurement, &SubmitterOptions{internal: true})
+	}
+	current := c.Stats()
+	previous := c.stats.reported
+	current.LastError, current.LastErrorAt = nil, time.Time{}
+	if current == previous {
+		// Nothing happened since the last report
+		return
+	}
+	c.stats.reported = current
+	values := map[string]Val{
+		"submitted": Sum(current.Submitted - previous.Submitted),
+		"merged":    Sum(current.Merged - previous.Merged),
+		"dropped":   Sum(current.Dropped - previous.Dropped),
+		"sent":      Sum(current.Sent - previous.Sent),
+		"failed":    Sum(current.Failed - previous.Failed),
+		"retried":   Sum(current.Retried - previous.Retried),
+		"bytes":     Sum(current.Bytes - previous.Bytes),
+	}
+	dimensions := map[string]interface{}{}
+	c.statsSubmitter("{}", time.Now(), values, dimensions, []byte("{}"))
+}
+
+// sendBatch sends the batch of currently buffered measurements. If it only
+// holds the client's own report, sending it isn't counted as activity to
+// report, since otherwise each report would cause another one and an idle
+// client would keep reporting forever.
+func (c *Client) sendBatch(ctx context.Context, batch Batch) (int, error) {
+	if len(batch) != 1 || len(batch[clientMeasurement]) == 0 {
+		return c.doSendBatch(ctx, batch)
+	}
+	before := c.Stats()
+	numInserted, err := c.doSendBatch(ctx, batch)
+	after := c.Stats()
+	c.mx.Lock()
+	reported := &c.stats.reported
+	reported.Sent += after.Sent - before.Sent
+	reported.Failed += after.Failed - before.Failed
+	reported.Retried += after.Retried - before.Retried
+	reported.Bytes += after.Bytes - before.Bytes
+	c.mx.Unlock()
+	return numInserted, err
+}
@@ -0,0 +1,88 @@
+package client
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStats(t *testing.T) {
+	transport := &mockTransport{"mock", true, &[]string{}}
+	bc := NewClient(&Options{
+		BatchInterval: time.Hour,
+		Transports:    []Transport{transport},
+	})
+	defer bc.Close(context.Background())
+
+	submit := bc.ReducingSubmitter("stats", 1)
+	submit(map[string]Val{"v": Sum(1)}, map[string]interface{}{"a": 1})
+	submit(map[string]Val{"v": Sum(1)}, map[string]interface{}{"a": 1})
+	submit(map[string]Val{"v": Sum(1)}, map[string]interface{}{"a": 2})
+	bc.Flush()
+
+	stats := bc.Stats()
+	assert.EqualValues(t, 3, stats.Submitted)
+	assert.EqualValues(t, 1, stats.Merged)
+	assert.EqualValues(t, 1, stats.Dropped)
+	// The mock transport inserts one measurement per name, so the overflow
+	// report counts as sent too
+	assert.EqualValues(t, 2, stats.Sent)
+	assert.EqualValues(t, 0, stats.Failed)
+	assert.NoError(t, stats.LastError)
+
+	transport.up = false
+	submit(map[string]Val{"v": Sum(1)}, map[string]interface{}{"a": 1})
+	bc.Flush()
+	stats = bc.Stats()
+	assert.EqualValues(t, 1, stats.Failed)
+	assert.Error(t, stats.LastError)
+	assert.False(t, stats.LastErrorAt.IsZero())
+}
+
+func TestReportStats(t *testing.T) {
+	reported := make(map[string]float64)
+	bc := NewClient(&Options{
+		BatchInterval: time.Hour,
+		Transports:    []Transport{&mockTransport{"mock", true, &[]string{}}},
+		ReportStats:   true,
+		BeforeSubmit: func(name string, ts time.Time, values map[string]Val, dimensionsJSON []byte) {
+			if name == clientMeasurement {
+				for key, val := range values {
+					reported[key] += val.Get()
+				}
+			}
+		},
+	})
+	defer bc.Close(context.Background())
+
+	bc.ReducingSubmitter("stats", 10)(map[string]Val{"v": Sum(1)}, map[string]interface{}{})
+	bc.Flush()
+	assert.EqualValues(t, 1, reported["submitted"])
+	assert.EqualValues(t, 0, reported["sent"], "Sends should be reported with the next batch")
+	bc.Flush()
+	assert.EqualValues(t, 1, reported["submitted"])
+	assert.EqualValues(t, 2, reported["sent"])
+}
+
+func TestIdleClientStopsReportingStats(t *testing.T) {
+	reports := 0
+	bc := NewClient(&Options{
+		BatchInterval: time.Hour,
+		Transports:    []Transport{&mockTransport{"mock", true, &[]string{}}},
+		ReportStats:   true,
+		BeforeSubmit: func(name string, ts time.Time, values map[string]Val, dimensionsJSON []byte) {
+			if name == clientMeasurement {
+				reports++
+			}
+		},
+	})
+	defer bc.Close(context.Background())
+
+	bc.ReducingSubmitter("stats", 10)(map[string]Val{"v": Sum(1)}, map[string]interface{}{})
+	for i := 0; i < 5; i++ {
+		bc.Flush()
+	}
+	assert.Equal(t, 2, reports, "Sending its own report shouldn't make an idle client report again")
+}
@@ -0,0 +1,136 @@
+package client
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	defaultProbeInterval = 15 * time.Minute
+)
+
+// Batch is a batch of measurements keyed by measurement name.
+type Batch map[string][]*Measurement
+
+// Result reports the outcome of sending a Batch.
+type Result struct {
+	// Inserted is the number of measurements that borda accepted.
+	Inserted int
+
+	// Unsent holds the measurements that are known not to have been inserted
+	// when sending failed partway, so that they can be sent again without
+	// inserting anything twice.
+	Unsent Batch
+}
+
+// Transport is a means of sending batches of measurements to borda. Custom
+// transports can be configured with Options.Transports.
+type Transport interface {
+	// Send sends the batch. If the batch was only partially inserted, Send
+	// should report the number of inserted measurements along with an error,
+	// and if it knows which measurements weren't inserted, those as Unsent.
+	Send(ctx context.Context, batch Batch) (Result, error)
+}
+
+// partialError is an error after which only the unsent part of a batch may be
+// sent again.
+type partialError struct {
+	error
+	unsent Batch
+}
+
+// httpTransport is the built-in Transport that sends batches via HTTP(S).
+type httpTransport struct {
+	c *Client
+}
+
+func (t *httpTransport) Send(ctx context.Context, batch Batch) (Result, error) {
+	numInserted, err := t.c.doSendBatchHTTP(ctx, batch)
+	return Result{Inserted: numInserted}, err
+}
+
+func (t *httpTransport) String() string {
+	return "http"
+}
+
+// rpcTransport is the built-in Transport that sends batches via gRPC.
+type rpcTransport struct {
+	c *Client
+}
+
+func (t *rpcTransport) Send(ctx context.Context, batch Batch) (Result, error) {
+	return t.c.doSendBatchRPC(ctx, batch)
+}
+
+func (t *rpcTransport) String() string {
+	return "rpc"
+}
+
+// ActiveTransport returns the Transport that's currently being used to send
+// batches. The built-in transports print as "rpc" and "http".
+func (c *Client) ActiveTransport() Transport {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	return c.transports[c.activeTransport]
+}
+
+// doSendBatch sends the batch using the active transport. If that fails
+// without inserting anything, it fails over to the next transport in order of
+// preference. If it fails partway, only the measurements that the transport
+// reports as unsent are sent with the next transport, and if those can't be
+// sent either, they're returned in a *partialError. Once a less preferred
+// transport is active, the preferred transports are probed again every
+// ProbeInterval.
+func (c *Client) doSendBatch(ctx context.Context, batch Batch) (numInserted int, err error) {
+	defer func() {
+		c.stats.recordSend(batch, numInserted, err)
+	}()
+
+	c.mx.Lock()
+	start := c.activeTransport
+	if start > 0 && time.Since(c.lastProbe) > c.options.ProbeInterval {
+		log.Debugf("Probing preferred transport %v", c.transports[0])
+		c.lastProbe = time.Now()
+		start = 0
+	}
+	c.mx.Unlock()
+
+	remaining := batch
+	for i := start; i < len(c.transports); i++ {
+		t := c.transports[i]
+		log.Debugf("Sending batch with %v", t)
+		result, sendErr := t.Send(ctx, remaining)
+		numInserted += result.Inserted
+		err = sendErr
+		if err == nil {
+			c.setActiveTransport(i)
+			return numInserted, nil
+		}
+		if result.Inserted > 0 {
+			if len(result.Unsent) == 0 {
+				// Don't fail over after a partial insert to avoid duplicates
+				return numInserted, err
+			}
+			remaining = result.Unsent
+		}
+		if i < len(c.transports)-1 {
+			log.Debugf("Unable to send batch with %v, failing over to %v: %v", t, c.transports[i+1], err)
+		}
+	}
+	if numInserted > 0 {
+		return numInserted, &partialError{err, remaining}
+	}
+	return numInserted, err
+}
+
+func (c *Client) setActiveTransport(i int) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	if i != c.activeTransport {
+		log.Debugf("Switching transport from %v to %v", c.transports[c.activeTransport], c.transports[i])
+		if c.activeTransport == 0 {
+			c.lastProbe = time.Now()
+		}
+		c.activeTransport = i
+	}
+}
@@ -0,0 +1,112 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/getlantern/zenodb/rpc"
+	"github.com/stretchr/testify/assert"
+)
+
+type mockTransport struct {
+	name     string
+	up       bool
+	sentWith *[]string
+}
+
+func (t *mockTransport) Send(ctx context.Context, batch Batch) (Result, error) {
+	if !t.up {
+		return Result{}, errors.New("down")
+	}
+	*t.sentWith = append(*t.sentWith, t.name)
+	return Result{Inserted: len(batch)}, nil
+}
+
+func TestFailover(t *testing.T) {
+	var sentWith []string
+	preferred := &mockTransport{"preferred", true, &sentWith}
+	fallback := &mockTransport{"fallback", true, &sentWith}
+	bc := NewClient(&Options{
+		BatchInterval: time.Hour,
+		Transports:    []Transport{preferred, fallback},
+	})
+	defer bc.Close(context.Background())
+
+	batch := Batch{"a": {{Name: "a"}}}
+	send := func() {
+		_, err := bc.doSendBatch(context.Background(), batch)
+		assert.NoError(t, err)
+	}
+
+	send()
+	assert.Equal(t, preferred, bc.ActiveTransport())
+
+	preferred.up = false
+	send()
+	assert.Equal(t, fallback, bc.ActiveTransport(), "Should have failed over")
+
+	preferred.up = true
+	send()
+	assert.Equal(t, fallback, bc.ActiveTransport(), "Shouldn't probe preferred transport before ProbeInterval")
+
+	bc.options.ProbeInterval = time.Nanosecond
+	send()
+	assert.Equal(t, preferred, bc.ActiveTransport(), "Should have switched back after probing")
+	assert.Equal(t, []string{"preferred", "fallback", "fallback", "preferred"}, sentWith)
+}
+
+func TestBuiltInTransports(t *testing.T) {
+	bc := NewClient(&Options{BatchInterval: time.Hour})
+	defer bc.Close(context.Background())
+	assert.Equal(t, "http", fmt.Sprint(bc.ActiveTransport()))
+}
+
+func TestPartialRPCFailure(t *testing.T) {
+	var sentWith []string
+	fallback := &mockTransport{"fallback", true, &sentWith}
+	bc := NewClient(&Options{
+		BatchInterval: time.Hour,
+		Streams:       map[string]string{"b": "failing"},
+		Retry:         &RetryPolicy{MaxAttempts: 1},
+	})
+	defer bc.Close(context.Background())
+	bc.rc = &streamFailingRPCClient{failStream: "failing"}
+
+	batch := Batch{
+		"a": {{Name: "a"}},
+		"b": {{Name: "b"}},
+		"c": {{Name: "c"}},
+	}
+	result, err := bc.doSendBatchRPC(context.Background(), batch)
+	assert.Error(t, err)
+	assert.Equal(t, 1, result.Inserted)
+	assert.Equal(t, Batch{"b": batch["b"], "c": batch["c"]}, result.Unsent, "Names that weren't inserted should be unsent")
+
+	bc.transports = []Transport{&rpcTransport{bc}}
+	numInserted, err := bc.doSendBatch(context.Background(), batch)
+	assert.Equal(t, 1, numInserted)
+	assert.Equal(t, Batch{"b": batch["b"], "c": batch["c"]}, toSpool(batch, numInserted, err), "Unsent names should be spooled")
+
+	bc.transports = []Transport{&rpcTransport{bc}, fallback}
+	numInserted, err = bc.doSendBatch(context.Background(), batch)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, numInserted, "Unsent names should have failed over")
+	assert.Equal(t, []string{"fallback"}, sentWith)
+}
+
+// streamFailingRPCClient fails to create inserters for failStream and inserts
+// everything into other streams.
+type streamFailingRPCClient struct {
+	rpc.Client
+	failStream string
+}
+
+func (rc *streamFailingRPCClient) NewInserter(ctx context.Context, stream string) (rpc.Inserter, error) {
+	if stream == rc.failStream {
+		return nil, errors.New("stream unavailable")
+	}
+	return &mockInserter{failAt: -1, report: &rpc.InsertReport{Succeeded: 1}}, nil
+}
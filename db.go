@@ -3,14 +3,16 @@ package borda
 import (
 	"time"
 
+	"github.com/getlantern/borda/routing"
 	"github.com/getlantern/goexpr/isp"
 	"github.com/getlantern/goexpr/isp/maxmind"
 	"github.com/getlantern/zenodb"
 	"gopkg.in/redis.v5"
 )
 
-// TDBSave creates a SaveFN that saves to an embedded tdb.DB
-func TDBSave(dir string, schemaFile string, aliasesFile string, ispdb string, redisClient *redis.Client, redisCacheSize int, maxWALSize int, walCompressionSize int, numPartitions int, clusterQueryConcurrency int, maxMemory float64) (SaveFunc, *zenodb.DB, error) {
+// TDBSave creates a SaveFN that saves to an embedded tdb.DB. Measurements are
+// inserted into the stream that streams selects for their name.
+func TDBSave(dir string, schemaFile string, aliasesFile string, ispdb string, redisClient *redis.Client, redisCacheSize int, maxWALSize int, walCompressionSize int, numPartitions int, clusterQueryConcurrency int, maxMemory float64, streams *routing.Table) (SaveFunc, *zenodb.DB, error) {
 	var ispProvider isp.Provider
 	var ispErr error
 	if ispdb != "" {
@@ -52,8 +54,12 @@ func TDBSave(dir string, schemaFile string, aliasesFile string, ispdb string, re
 	}()
 
 	return func(m *Measurement) error {
-		return db.Insert("inbound",
-			time.Now(), // use now so that clients with bad clocks don't throw things off m.Ts,
+		ts := m.Ts
+		if ts.IsZero() {
+			ts = time.Now()
+		}
+		return db.Insert(streams.StreamFor(m.Name),
+			ts,
 			m.Dimensions,
 			m.Values)
 	}, db, nil
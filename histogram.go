@@ -0,0 +1,109 @@
+package borda
+
+import (
+	"encoding/json"
+	"math"
+	"sort"
+
+	"github.com/getlantern/borda/wire"
+	"github.com/getlantern/errors"
+)
+
+var (
+	// DefaultQuantiles are the quantiles that are stored for histograms by
+	// default.
+	DefaultQuantiles = []float64{0.5, 0.95, 0.99}
+)
+
+// Histogram is a mergeable quantile sketch (DDSketch) as submitted by clients
+// in the form {"type": "histogram", "accuracy": 0.01, "pos": [index, count,
+// ...], "neg": [index, count, ...], "zeros": 0, "sum": 0} (see
+// wire.Histogram).
+type Histogram struct {
+	Accuracy float64
+	Pos      []float64
+	Neg      []float64
+	Zeros    float64
+	Sum      float64
+
+	gamma float64
+	pos   []bin
+	neg   []bin
+	count float64
+}
+
+type bin struct {
+	index int
+	count float64
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface.
+func (h *Histogram) UnmarshalJSON(b []byte) error {
+	hj := &wire.Histogram{}
+	err := json.Unmarshal(b, hj)
+	if err != nil {
+		return err
+	}
+	h.Accuracy, h.Pos, h.Neg, h.Zeros, h.Sum = hj.Accuracy, hj.Pos, hj.Neg, hj.Zeros, hj.Sum
+	if h.Accuracy <= 0 || h.Accuracy >= 1 {
+		return errors.New("Invalid histogram accuracy %v", h.Accuracy)
+	}
+	h.gamma = (1 + h.Accuracy) / (1 - h.Accuracy)
+	h.count = h.Zeros
+	h.pos, err = h.bins(h.Pos)
+	if err != nil {
+		return err
+	}
+	h.neg, err = h.bins(h.Neg)
+	return err
+}
+
+func (h *Histogram) bins(flattened []float64) ([]bin, error) {
+	if len(flattened)%2 != 0 {
+		return nil, errors.New("Histogram bins must be index/count pairs")
+	}
+	bins := make([]bin, 0, len(flattened)/2)
+	for i := 0; i < len(flattened); i += 2 {
+		bins = append(bins, bin{int(flattened[i]), flattened[i+1]})
+		h.count += flattened[i+1]
+	}
+	sort.Slice(bins, func(i, j int) bool {
+		return bins[i].index < bins[j].index
+	})
+	return bins, nil
+}
+
+func (h *Histogram) value(index int) float64 {
+	return 2 * math.Pow(h.gamma, float64(index)) / (h.gamma + 1)
+}
+
+// Count returns the number of values recorded in the histogram.
+func (h *Histogram) Count() float64 {
+	return h.count
+}
+
+// Quantile returns the value at the given quantile (between 0 and 1).
+func (h *Histogram) Quantile(q float64) float64 {
+	if h.count == 0 {
+		return 0
+	}
+	rank := q * (h.count - 1)
+	var cumulative float64
+	for i := len(h.neg) - 1; i >= 0; i-- {
+		cumulative += h.neg[i].count
+		if cumulative > rank {
+			return -1 * h.value(h.neg[i].index)
+		}
+	}
+	cumulative += h.Zeros
+	if cumulative > rank || len(h.pos) == 0 {
+		return 0
+	}
+	for _, b := range h.pos {
+		cumulative += b.count
+		if cumulative > rank {
+			return h.value(b.index)
+		}
+	}
+	return h.value(h.pos[len(h.pos)-1].index)
+}
@@ -1,14 +1,24 @@
 package borda
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
 	"math/rand"
 	"net/http"
+	"strconv"
+	"sync"
 	"sync/atomic"
 	"time"
+
+	"github.com/getlantern/borda/wire"
+	"github.com/getlantern/errors"
+	"github.com/klauspost/compress/zstd"
 )
 
 const (
@@ -17,21 +27,178 @@ const (
 
 	// ContentTypeJSON is the allowed content type
 	ContentTypeJSON = "application/json"
+
+	// ContentTypeNDJSON is the content type for newline-delimited JSON, which
+	// is decoded and saved one measurement at a time
+	ContentTypeNDJSON = "application/x-ndjson"
+
+	// ContentEncoding is the key for the Content-Encoding header
+	ContentEncoding = "Content-Encoding"
+
+	// ContentEncodingGzip indicates a gzip compressed request body
+	ContentEncodingGzip = "gzip"
+
+	// ContentEncodingZstd indicates a zstd compressed request body
+	ContentEncodingZstd = "zstd"
+
+	// DefaultMaxDecompressedBytes is the default for
+	// Handler.MaxDecompressedBytes
+	DefaultMaxDecompressedBytes = 50 * 1024 * 1024
+
+	// maxZstdWindow caps the window that zstd frames may declare, since the
+	// decoder allocates buffers for the window before anything is decoded.
+	// 8 MB is the window that RFC 8878 recommends decoders to support.
+	maxZstdWindow = 8 * 1024 * 1024
+
+	// DefaultMaxPast is the default for Handler.MaxPast
+	DefaultMaxPast = 24 * time.Hour
+
+	// DefaultMaxFuture is the default for Handler.MaxFuture
+	DefaultMaxFuture = 5 * time.Minute
 )
 
+// Result is returned to clients in response to submitting measurements. It
+// reports how many measurements were accepted as well as the indices of
+// measurements that were rejected or that failed to save. Indices refer to the
+// position of the measurement in the submitted batch.
+type Result struct {
+	Accepted int          `json:"accepted"`
+	Rejected []*Rejection `json:"rejected,omitempty"`
+	Failed   []int        `json:"failed,omitempty"`
+}
+
+// Rejection records why the measurement at Index was rejected.
+type Rejection struct {
+	Index  int    `json:"index"`
+	Reason string `json:"reason"`
+}
+
+func (r *Result) reject(i int, reason string) {
+	log.Tracef("Rejecting measurement %d: %v", i, reason)
+	r.Rejected = append(r.Rejected, &Rejection{i, reason})
+}
+
 // Handler is an http.Handler that reads Measurements from HTTP and saves them
 // to the database.
 type Handler struct {
-	Save                 SaveFunc
-	SampleRate           float64
+	Save       SaveFunc
+	SampleRate float64
+
+	// MaxPast and MaxFuture bound how far a measurement's (skew-corrected)
+	// timestamp may lie in the past or future. They default to DefaultMaxPast
+	// and DefaultMaxFuture.
+	MaxPast   time.Duration
+	MaxFuture time.Duration
+
+	// ClampTimestamps causes timestamps outside of MaxPast and MaxFuture to be
+	// clamped to the nearest allowed time. By default, such measurements are
+	// discarded.
+	ClampTimestamps bool
+
+	// Quantiles are the quantiles that are stored for histogram values, each in
+	// a field named like <name>_p99 (see wire.QuantileField). Defaults to
+	// DefaultQuantiles.
+	Quantiles []float64
+
+	// MaxDecompressedBytes caps the size to which compressed request bodies may
+	// decompress, protecting against zip bombs. Defaults to
+	// DefaultMaxDecompressedBytes.
+	MaxDecompressedBytes int64
+
+	// MaxBodyBytes caps the size of request bodies as received. Defaults to
+	// DefaultMaxBodyBytes.
+	MaxBodyBytes int64
+
+	// MaxBatchSize caps the number of measurements per request. Defaults to
+	// DefaultMaxBatchSize. When measurements are queued, it's also capped at
+	// QueueSize, since larger batches could never be admitted to the queue.
+	MaxBatchSize int
+
+	// MaxValues and MaxDimensions cap the number of values and dimensions per
+	// measurement. They default to DefaultMaxValues and DefaultMaxDimensions.
+	MaxValues     int
+	MaxDimensions int
+
+	// MaxKeyLength caps the length of measurement names as well as value and
+	// dimension keys, while MaxValueLength caps the length of string
+	// dimension values. They default to DefaultMaxKeyLength and
+	// DefaultMaxValueLength.
+	MaxKeyLength   int
+	MaxValueLength int
+
+	// APIKeys, if specified, requires clients to authenticate with one of these
+	// keys in the wire.APIKeyHeader. Measurements are then limited to the names
+	// and rate quota of the key and recorded with its ID in the APIKeyDimension.
+	APIKeys *APIKeys
+
+	// IPRateLimit, if specified, limits the requests and measurements that
+	// each client IP may submit.
+	IPRateLimit *RateLimit
+
+	// TrustCDNHeaders causes client IPs to be taken from the Cf-Connecting-Ip
+	// or Cloudfront-Viewer-Address header if present. Since clients can set
+	// these headers themselves, this should only be enabled if the Handler is
+	// reachable exclusively through a CDN. By default, the IP of the
+	// connection is used.
+	TrustCDNHeaders bool
+
+	// APIKeyRateLimit, if specified, limits the requests and measurements that
+	// may be submitted with each API key, in addition to the key's own quota.
+	APIKeyRateLimit *RateLimit
+
+	// QueueSize, if positive, makes the Handler save measurements
+	// asynchronously from a queue of this size rather than while handling the
+	// request. Requests whose measurements don't fit in the queue are answered
+	// with 503 Service Unavailable and a Retry-After header. Since queued
+	// measurements are saved after responding, failures to save them aren't
+	// reported to clients.
+	QueueSize int
+
+	// QueueWorkers is the number of goroutines saving measurements from the
+	// queue. Defaults to DefaultQueueWorkers.
+	QueueWorkers int
+
+	// RetryAfter is how long clients are asked to wait before retrying when
+	// the queue is full. Defaults to DefaultRetryAfter.
+	RetryAfter time.Duration
+
 	receivedMeasurements int64
+	outOfRange           int64
+	queueDepth           int64
+	queue                chan *queuedMeasurement
+	ipLimiter            *rateLimiter
+	apiKeyLimiter        *rateLimiter
+	startOnce            sync.Once
 }
 
-// ServeHTTP implements the http.Handler interface and supports publishing measurements via HTTP.
-func (h *Handler) Measurements(resp http.ResponseWriter, req *http.Request) {
+// start applies defaults to the Handler's configuration and starts its queue
+// and rate limiters. It runs once, before the first request is handled, so that
+// requests only ever read the configuration.
+func (h *Handler) start() {
 	if h.SampleRate == 0 {
 		h.SampleRate = 1
 	}
+	if h.MaxPast <= 0 {
+		h.MaxPast = DefaultMaxPast
+	}
+	if h.MaxFuture <= 0 {
+		h.MaxFuture = DefaultMaxFuture
+	}
+	if len(h.Quantiles) == 0 {
+		h.Quantiles = DefaultQuantiles
+	}
+	h.applyLimitDefaults()
+	if h.QueueSize > 0 && h.MaxBatchSize > h.QueueSize {
+		h.MaxBatchSize = h.QueueSize
+	}
+	h.ipLimiter = newRateLimiter("ip", h.IPRateLimit)
+	h.apiKeyLimiter = newRateLimiter("api_key", h.APIKeyRateLimit)
+	h.startQueue()
+}
+
+// ServeHTTP implements the http.Handler interface and supports publishing measurements via HTTP.
+func (h *Handler) Measurements(resp http.ResponseWriter, req *http.Request) {
+	h.startOnce.Do(h.start)
 
 	if req.Method != http.MethodPost {
 		resp.WriteHeader(http.StatusMethodNotAllowed)
@@ -40,52 +207,420 @@ func (h *Handler) Measurements(resp http.ResponseWriter, req *http.Request) {
 	}
 
 	contentType := req.Header.Get(ContentType)
-	if contentType != ContentTypeJSON {
+	if contentType != ContentTypeJSON && contentType != ContentTypeNDJSON {
 		resp.WriteHeader(http.StatusUnsupportedMediaType)
 		fmt.Fprintf(resp, "Media type %v unsupported\n", contentType)
 		return
 	}
 
+	key, authorized := h.authenticate(req)
+	if !authorized {
+		resp.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprintf(resp, "Missing or unknown %v\n", wire.APIKeyHeader)
+		return
+	}
+	src := &source{clientIP(req, h.TrustCDNHeaders), key}
+	if r := h.limit(src, true, 0); r != nil {
+		refuse(resp, r)
+		return
+	}
+
 	defer req.Body.Close()
+	req.Body = &limitedReader{req.Body, req.Body, h.MaxBodyBytes, errBodyTooLarge}
 	if rand.Float64() >= h.SampleRate {
 		io.Copy(ioutil.Discard, req.Body)
-	} else {
-		dec := json.NewDecoder(req.Body)
-		var measurements []*Measurement
-		err := dec.Decode(&measurements)
-		if err != nil {
-			badRequest(resp, "Error decoding JSON: %v", err)
+		resp.WriteHeader(http.StatusCreated)
+		return
+	}
+
+	body, err := h.decompress(req)
+	if err == errUnsupportedEncoding {
+		resp.WriteHeader(http.StatusUnsupportedMediaType)
+		fmt.Fprintf(resp, "Content encoding %v unsupported\n", req.Header.Get(ContentEncoding))
+		return
+	}
+	if err != nil {
+		badRequest(resp, "Error decompressing body: %v", err)
+		return
+	}
+	defer body.Close()
+
+	if contentType == ContentTypeNDJSON {
+		h.measurementsNDJSON(resp, req, body, src)
+		return
+	}
+
+	measurements, err := h.decodeBatch(json.NewDecoder(body))
+	if err != nil {
+		h.decodeFailed(resp, err)
+		return
+	}
+
+	if len(measurements) == 0 {
+		badRequest(resp, "Please include at least 1 measurement", err)
+		return
+	}
+
+	if r := h.admit(src, len(measurements)); r != nil {
+		refuse(resp, r)
+		return
+	}
+	now, skew := time.Now(), clockSkew(req)
+	result := &Result{}
+	for i, m := range measurements {
+		h.process(result, i, m, now, skew, src.key)
+	}
+	h.release(len(measurements) - result.Accepted)
+	writeResult(resp, result)
+}
+
+// measurementsNDJSON reads newline-delimited JSON measurements from body and
+// saves them one at a time. Malformed lines are rejected without affecting the
+// rest of the body. Blank lines are ignored and not counted when indexing
+// measurements. Lines beyond MaxBatchSize are rejected without being decoded.
+// Measurements that aren't admitted (e.g. because the queue is
+// full) are reported as failed, and if none are admitted, the request is
+// refused. If the body fails to read partway (e.g. because it exceeds
+// MaxBodyBytes), the results of the measurements read so far are still
+// reported.
+func (h *Handler) measurementsNDJSON(resp http.ResponseWriter, req *http.Request, body io.Reader, src *source) {
+	now, skew := time.Now(), clockSkew(req)
+	result := &Result{}
+	var lastRefusal *refusal
+	batchTooLarge := false
+	r := bufio.NewReader(body)
+	for i := 0; ; {
+		line, err := r.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			h.readFailed(resp, result, i, err)
 			return
 		}
+		if len(bytes.TrimSpace(line)) > 0 {
+			m := &Measurement{}
+			if i >= h.MaxBatchSize {
+				if !batchTooLarge {
+					limitsExceeded.Add("batch_size", 1)
+					batchTooLarge = true
+				}
+				result.reject(i, fmt.Sprintf("Batch exceeds %d measurements", h.MaxBatchSize))
+			} else if decodeErr := json.Unmarshal(line, m); decodeErr != nil {
+				result.reject(i, fmt.Sprintf("Error decoding JSON: %v", decodeErr))
+			} else if r := h.admit(src, 1); r != nil {
+				lastRefusal = r
+				result.Failed = append(result.Failed, i)
+			} else {
+				accepted := result.Accepted
+				h.process(result, i, m, now, skew, src.key)
+				h.release(1 - (result.Accepted - accepted))
+			}
+			i++
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	if lastRefusal != nil && result.Accepted == 0 {
+		refuse(resp, lastRefusal)
+		return
+	}
+	writeResult(resp, result)
+}
 
-		if len(measurements) == 0 {
-			badRequest(resp, "Please include at least 1 measurement", err)
+// readFailed answers an NDJSON request whose body failed to read after the
+// measurements before index i were processed. If there were none, the request
+// fails like any other that can't be decoded. Otherwise, their results are
+// reported along with a rejection at index i that covers the unread rest.
+func (h *Handler) readFailed(resp http.ResponseWriter, result *Result, i int, err error) {
+	status, reason := http.StatusBadRequest, fmt.Sprintf("Error reading body: %v", err)
+	if err == errBodyTooLarge || err == errDecompressedTooLarge {
+		status, reason = h.decodeFailure(err)
+	}
+	if i == 0 {
+		resp.WriteHeader(status)
+		fmt.Fprintln(resp, reason)
+		return
+	}
+	result.reject(i, reason+", this and subsequent measurements were not read")
+	writeResult(resp, result)
+}
+
+// process validates, corrects and saves a single measurement, recording the
+// outcome in result.
+func (h *Handler) process(result *Result, i int, m *Measurement, now time.Time, skew time.Duration, key *APIKey) {
+	if m.valuesErr != nil {
+		result.reject(i, m.valuesErr.Error())
+		return
+	}
+	if reason := h.checkLimits(m); reason != "" {
+		result.reject(i, reason)
+		return
+	}
+	m.expandHistograms(h.Quantiles)
+	if reason := validate(m); reason != "" {
+		result.reject(i, reason)
+		return
+	}
+	if key != nil {
+		if !key.allows(m.Name) {
+			result.reject(i, "Name not allowed for API key")
 			return
 		}
+		if m.Dimensions == nil {
+			m.Dimensions = make(map[string]interface{})
+		}
+		m.Dimensions[APIKeyDimension] = key.ID
+	}
+	if !h.correctTimestamp(m, now, skew) {
+		result.reject(i, "Timestamp out of range")
+		return
+	}
+	atomic.AddInt64(&h.receivedMeasurements, 1)
+	err := h.save(m)
+	if err != nil {
+		log.Errorf("Error saving measurement, continuing: %v", err)
+		result.Failed = append(result.Failed, i)
+		return
+	}
+	result.Accepted++
+}
 
-		for _, m := range measurements {
-			if m.Name == "" {
-				badRequest(resp, "Missing name")
-				return
-			}
+// authenticate looks up the API key with which the request was made. If the
+// Handler doesn't require API keys, this returns nil and true.
+func (h *Handler) authenticate(req *http.Request) (*APIKey, bool) {
+	if h.APIKeys == nil {
+		return nil, true
+	}
+	key := h.APIKeys.get(req.Header.Get(wire.APIKeyHeader))
+	if key == nil {
+		stats.Add("api_key_unauthorized", 1)
+		return nil, false
+	}
+	return key, true
+}
 
-			if m.Values == nil || len(m.Values) == 0 {
-				badRequest(resp, "Need at least one value")
-				return
-			}
+// source identifies the client that submitted a request.
+type source struct {
+	ip  string
+	key *APIKey
+}
+
+// refusal describes why measurements weren't admitted.
+type refusal struct {
+	status     int
+	retryAfter time.Duration
+	reason     string
+}
+
+// limit applies rate limits to the source's requests (if request is true) or
+// measurements, returning a refusal if the source exceeded any of them.
+func (h *Handler) limit(src *source, request bool, n int) *refusal {
+	now := time.Now()
+	if ok, wait := h.ipLimiter.allow(src.ip, request, n, now); !ok {
+		return &refusal{http.StatusTooManyRequests, wait, "Rate limit for IP exceeded"}
+	}
+	if src.key != nil {
+		if ok, wait := h.apiKeyLimiter.allow(src.key.ID, request, n, now); !ok {
+			return &refusal{http.StatusTooManyRequests, wait, "Rate limit for API key exceeded"}
 		}
+	}
+	return nil
+}
 
-		atomic.AddInt64(&h.receivedMeasurements, int64(len(measurements)))
-		log.Tracef("Received %d measurements", len(measurements))
-		for _, m := range measurements {
-			err := h.Save(m)
-			if err != nil {
-				log.Errorf("Error saving measurement, continuing: %v", err)
-			}
+// admit checks whether n more measurements from the given source may be
+// accepted, reserving room for them in the queue. If not, it returns a
+// refusal.
+func (h *Handler) admit(src *source, n int) *refusal {
+	if r := h.limit(src, false, n); r != nil {
+		return r
+	}
+	if key := src.key; key != nil && key.quota != nil {
+		if ok, wait := key.quota.take(float64(n), time.Now()); !ok {
+			stats.Add("api_key_quota_exceeded", 1)
+			return &refusal{http.StatusTooManyRequests, wait, "Rate quota for API key exceeded"}
+		}
+	}
+	if !h.reserve(n) {
+		return &refusal{http.StatusServiceUnavailable, h.RetryAfter, "Queue full, please retry later"}
+	}
+	return nil
+}
+
+// refuse answers the request with the refusal, asking the client to retry
+// after the refusal's retryAfter (rounded up to the second).
+func refuse(resp http.ResponseWriter, r *refusal) {
+	retryAfter := int(math.Ceil(r.retryAfter.Seconds()))
+	if retryAfter < 1 {
+		retryAfter = 1
+	}
+	resp.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	resp.WriteHeader(r.status)
+	fmt.Fprintln(resp, r.reason)
+}
+
+// writeResult writes the result as JSON. The status is 201 Created if any
+// measurements were accepted, 400 Bad Request if all were rejected and 500
+// Internal Server Error if some failed to save and none were accepted.
+func writeResult(resp http.ResponseWriter, result *Result) {
+	log.Tracef("Accepted %d measurements, rejected %d, failed to save %d", result.Accepted, len(result.Rejected), len(result.Failed))
+	status := http.StatusCreated
+	if result.Accepted == 0 {
+		if len(result.Failed) > 0 {
+			status = http.StatusInternalServerError
+		} else if len(result.Rejected) > 0 {
+			status = http.StatusBadRequest
+		}
+	}
+	resp.Header().Set(ContentType, ContentTypeJSON)
+	resp.WriteHeader(status)
+	json.NewEncoder(resp).Encode(result)
+}
+
+// validate returns the reason for which the given measurement is invalid, or
+// "" if it's valid.
+func validate(m *Measurement) string {
+	if m.Name == "" {
+		return "Missing name"
+	}
+	if len(m.Values) == 0 {
+		return "Need at least one value"
+	}
+	return ""
+}
+
+var (
+	errUnsupportedEncoding  = errors.New("unsupported content encoding")
+	errDecompressedTooLarge = errors.New("decompressed body too large")
+)
+
+// decompress returns a reader for the request body that decompresses it
+// according to its Content-Encoding. Compressed bodies are limited to
+// MaxDecompressedBytes.
+func (h *Handler) decompress(req *http.Request) (io.ReadCloser, error) {
+	switch req.Header.Get(ContentEncoding) {
+	case "", "identity":
+		return ioutil.NopCloser(req.Body), nil
+	case ContentEncodingGzip:
+		r, err := gzip.NewReader(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		return &limitedReader{r, r, h.MaxDecompressedBytes, errDecompressedTooLarge}, nil
+	case ContentEncodingZstd:
+		maxWindow := uint64(maxZstdWindow)
+		if uint64(h.MaxDecompressedBytes) < maxWindow {
+			maxWindow = uint64(h.MaxDecompressedBytes)
+		}
+		if maxWindow < zstd.MinWindowSize {
+			maxWindow = zstd.MinWindowSize
+		}
+		r, err := zstd.NewReader(req.Body,
+			zstd.WithDecoderConcurrency(1),
+			zstd.WithDecoderLowmem(true),
+			zstd.WithDecoderMaxMemory(uint64(h.MaxDecompressedBytes)),
+			zstd.WithDecoderMaxWindow(maxWindow))
+		if err != nil {
+			return nil, err
+		}
+		return &limitedReader{zstdReader{r}, closerFunc(r.Close), h.MaxDecompressedBytes, errDecompressedTooLarge}, nil
+	default:
+		return nil, errUnsupportedEncoding
+	}
+}
+
+// zstdReader reports frames that exceed the decoder's limits as
+// errDecompressedTooLarge.
+type zstdReader struct {
+	*zstd.Decoder
+}
+
+func (r zstdReader) Read(p []byte) (int, error) {
+	n, err := r.Decoder.Read(p)
+	if err == zstd.ErrWindowSizeExceeded || err == zstd.ErrDecoderSizeExceeded {
+		err = errDecompressedTooLarge
+	}
+	return n, err
+}
+
+// limitedReader is a reader that fails with err once more than remaining bytes
+// have been read. Bytes within the limit are returned before failing, so that
+// readers can make use of what precedes the failure.
+type limitedReader struct {
+	r         io.Reader
+	closer    io.Closer
+	remaining int64
+	err       error
+}
+
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	if lr.remaining < 0 {
+		return 0, lr.err
+	}
+	if int64(len(p)) > lr.remaining+1 {
+		p = p[:lr.remaining+1]
+	}
+	n, err := lr.r.Read(p)
+	lr.remaining -= int64(n)
+	if lr.remaining < 0 {
+		// Only one byte past the limit could have been read
+		n--
+		if n == 0 {
+			return 0, lr.err
 		}
+		return n, nil
+	}
+	return n, err
+}
+
+func (lr *limitedReader) Close() error {
+	return lr.closer.Close()
+}
+
+type closerFunc func()
+
+func (fn closerFunc) Close() error {
+	fn()
+	return nil
+}
+
+// clockSkew estimates the client's clock skew from the wire.SentAtHeader.
+func clockSkew(req *http.Request) time.Duration {
+	sentAt := req.Header.Get(wire.SentAtHeader)
+	if sentAt == "" {
+		return 0
+	}
+	clientNow, err := time.Parse(time.RFC3339Nano, sentAt)
+	if err != nil {
+		log.Tracef("Ignoring unparseable %v header %v: %v", wire.SentAtHeader, sentAt, err)
+		return 0
 	}
+	return time.Now().Sub(clientNow)
+}
 
-	resp.WriteHeader(http.StatusCreated)
+// correctTimestamp shifts the timestamp of the given measurement by the
+// client's clock skew and clamps it to the allowed range. Measurements without
+// a timestamp are stamped with now. If the timestamp is out of range and
+// ClampTimestamps is false, this returns false to indicate that the measurement
+// should be discarded.
+func (h *Handler) correctTimestamp(m *Measurement, now time.Time, skew time.Duration) bool {
+	if m.Ts.IsZero() {
+		m.Ts = now
+		return true
+	}
+	m.Ts = m.Ts.Add(skew)
+	earliest := now.Add(-1 * h.MaxPast)
+	latest := now.Add(h.MaxFuture)
+	if m.Ts.Before(earliest) || m.Ts.After(latest) {
+		if !h.ClampTimestamps {
+			atomic.AddInt64(&h.outOfRange, 1)
+			return false
+		}
+		if m.Ts.Before(earliest) {
+			m.Ts = earliest
+		} else {
+			m.Ts = latest
+		}
+	}
+	return true
 }
 
 func (h *Handler) Ping(resp http.ResponseWriter, req *http.Request) {
@@ -100,8 +635,9 @@ func (h *Handler) Report() {
 	for range ticker.C {
 		delta := time.Now().Sub(start)
 		measurements := float64(atomic.SwapInt64(&h.receivedMeasurements, 0))
+		outOfRange := atomic.SwapInt64(&h.outOfRange, 0)
 		tps := measurements / delta.Seconds()
-		log.Debugf("Processed %d measurements at %d per second", int64(measurements), int(tps))
+		log.Debugf("Processed %d measurements at %d per second, discarded %d with out of range timestamps, %d queued", int64(measurements), int(tps), outOfRange, atomic.LoadInt64(&h.queueDepth))
 		start = time.Now()
 	}
 }
@@ -2,13 +2,22 @@ package borda
 
 import (
 	"bytes"
+	"compress/gzip"
 	"encoding/json"
+	"math"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/getlantern/borda/wire"
+	"github.com/getlantern/errors"
 	"github.com/getlantern/eventual"
+	"github.com/klauspost/compress/zstd"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -98,6 +107,26 @@ func TestHTTPRoundTrip(t *testing.T) {
 	}
 }
 
+func TestConcurrentRequests(t *testing.T) {
+	var saved int64
+	h := &Handler{Save: func(m *Measurement) error {
+		atomic.AddInt64(&saved, 1)
+		return nil
+	}}
+	b, _ := json.Marshal([]*Measurement{good})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.Equal(t, http.StatusCreated, postMeasurements(h, ContentTypeJSON, b, nil).Code)
+		}()
+	}
+	wg.Wait()
+	assert.EqualValues(t, 8, atomic.LoadInt64(&saved))
+}
+
 func httpRequest(addr string, contentType string, measurements []*Measurement) (*http.Response, error) {
 	client := &http.Client{}
 	b := new(bytes.Buffer)
@@ -117,6 +146,19 @@ func httpRequest(addr string, contentType string, measurements []*Measurement) (
 	return client.Do(req)
 }
 
+// postMeasurements posts the body to the Handler with the given content type
+// and additional headers, returning the recorded response.
+func postMeasurements(h *Handler, contentType string, body []byte, headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/measurements", bytes.NewReader(body))
+	req.Header.Set(ContentType, contentType)
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	resp := httptest.NewRecorder()
+	h.Measurements(resp, req)
+	return resp
+}
+
 func validateMeasurement(t *testing.T, m *Measurement) {
 	assert.Equal(t, "combined", m.Name, "Incorrect measurement key")
 	assert.NotNil(t, m.Ts, "Missing timestamp")
@@ -132,3 +174,229 @@ func validateMeasurement(t *testing.T, m *Measurement) {
 		"field_float": float64(2.1),
 	}, m.Values, "Incorrect fields")
 }
+
+func TestTimestampCorrection(t *testing.T) {
+	var saved []*Measurement
+	h := &Handler{Save: func(m *Measurement) error {
+		saved = append(saved, m)
+		return nil
+	}}
+
+	clientNow := time.Now().Add(-1 * time.Hour)
+	post := func(ts time.Time) int {
+		saved = nil
+		m := &Measurement{Name: "combined", Ts: ts, Values: good.Values}
+		b, _ := json.Marshal([]*Measurement{m})
+		return postMeasurements(h, ContentTypeJSON, b, map[string]string{wire.SentAtHeader: clientNow.Format(time.RFC3339Nano)}).Code
+	}
+
+	assert.Equal(t, http.StatusCreated, post(clientNow.Add(-1*time.Minute)))
+	if assert.Len(t, saved, 1) {
+		assert.WithinDuration(t, time.Now().Add(-1*time.Minute), saved[0].Ts, 5*time.Second, "Timestamp should have been corrected for skew")
+	}
+
+	assert.Equal(t, http.StatusBadRequest, post(clientNow.Add(-48*time.Hour)))
+	assert.Empty(t, saved, "Measurement too far in the past should have been discarded")
+
+	h.ClampTimestamps = true
+	assert.Equal(t, http.StatusCreated, post(clientNow.Add(time.Hour)))
+	if assert.Len(t, saved, 1) {
+		assert.WithinDuration(t, time.Now().Add(DefaultMaxFuture), saved[0].Ts, 5*time.Second, "Timestamp should have been clamped")
+	}
+}
+
+func TestCompressedBodies(t *testing.T) {
+	saved := 0
+	h := &Handler{Save: func(m *Measurement) error {
+		saved++
+		return nil
+	}}
+
+	post := func(encoding string, body []byte) int {
+		return postMeasurements(h, ContentTypeJSON, body, map[string]string{ContentEncoding: encoding}).Code
+	}
+
+	b, _ := json.Marshal([]*Measurement{good})
+	gzipped := new(bytes.Buffer)
+	gzw := gzip.NewWriter(gzipped)
+	gzw.Write(b)
+	gzw.Close()
+	zenc, _ := zstd.NewWriter(nil)
+	zstded := zenc.EncodeAll(b, nil)
+
+	assert.Equal(t, http.StatusCreated, post(ContentEncodingGzip, gzipped.Bytes()))
+	assert.Equal(t, http.StatusCreated, post(ContentEncodingZstd, zstded))
+	assert.Equal(t, 2, saved)
+	assert.Equal(t, http.StatusUnsupportedMediaType, post("br", b))
+	assert.Equal(t, http.StatusBadRequest, post(ContentEncodingGzip, b))
+
+	h.MaxDecompressedBytes = int64(len(b) - 1)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, post(ContentEncodingGzip, gzipped.Bytes()))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, post(ContentEncodingZstd, zstded))
+	assert.Equal(t, 2, saved)
+}
+
+func TestZstdWindowLimit(t *testing.T) {
+	h := &Handler{Save: func(m *Measurement) error {
+		return nil
+	}}
+
+	// A frame that declares a 256 MB window (window descriptor 18 << 3)
+	// followed by a single raw block containing "[]"
+	frame := []byte{0x28, 0xb5, 0x2f, 0xfd, 0x00, 18 << 3, 0x11, 0x00, 0x00, '[', ']'}
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	code := postMeasurements(h, ContentTypeJSON, frame, map[string]string{ContentEncoding: ContentEncodingZstd}).Code
+	runtime.ReadMemStats(&after)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, code)
+	assert.True(t, after.TotalAlloc-before.TotalAlloc < 32*1024*1024, "Oversized window shouldn't be allocated")
+}
+
+func TestNDJSON(t *testing.T) {
+	var saved []*Measurement
+	h := &Handler{Save: func(m *Measurement) error {
+		saved = append(saved, m)
+		return nil
+	}}
+
+	body := new(bytes.Buffer)
+	enc := json.NewEncoder(body)
+	enc.Encode(good)
+	body.WriteString("Not valid JSON\n\n")
+	enc.Encode(missingName)
+	enc.Encode(missingTS)
+	body.WriteString(`{"name": "combined", "values": {"field_float": 2.1}}`)
+
+	resp := postMeasurements(h, ContentTypeNDJSON, body.Bytes(), nil)
+	if !assert.Equal(t, http.StatusCreated, resp.Code) {
+		return
+	}
+	result := &Result{}
+	if assert.NoError(t, json.NewDecoder(resp.Body).Decode(result)) {
+		assert.Equal(t, 3, result.Accepted)
+		if assert.Len(t, result.Rejected, 2) {
+			assert.Equal(t, 1, result.Rejected[0].Index)
+			assert.Equal(t, 2, result.Rejected[1].Index)
+			assert.Equal(t, "Missing name", result.Rejected[1].Reason)
+		}
+	}
+	if assert.Len(t, saved, 3) {
+		validateMeasurement(t, saved[0])
+	}
+}
+
+func TestNDJSONBodyTooLarge(t *testing.T) {
+	saved := 0
+	h := &Handler{Save: func(m *Measurement) error {
+		saved++
+		return nil
+	}}
+
+	line, _ := json.Marshal(good)
+	line = append(line, '\n')
+	body := bytes.Repeat(line, 5)
+	h.MaxBodyBytes = int64(len(line)*3 + len(line)/2)
+
+	resp := postMeasurements(h, ContentTypeNDJSON, body, nil)
+	if !assert.Equal(t, http.StatusCreated, resp.Code, "Lines read before exceeding the limit should be accepted") {
+		return
+	}
+	result := &Result{}
+	if assert.NoError(t, json.NewDecoder(resp.Body).Decode(result)) {
+		assert.Equal(t, 3, result.Accepted)
+		if assert.Len(t, result.Rejected, 1) {
+			assert.Equal(t, 3, result.Rejected[0].Index)
+			assert.Contains(t, result.Rejected[0].Reason, "Body exceeds")
+		}
+	}
+	assert.Equal(t, 3, saved)
+
+	h.MaxBodyBytes = int64(len(line) / 2)
+	resp = postMeasurements(h, ContentTypeNDJSON, body, nil)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.Code, "Body exceeding the limit before any line should be refused")
+}
+
+func TestPartialResults(t *testing.T) {
+	saved := 0
+	h := &Handler{Save: func(m *Measurement) error {
+		if m.Dimensions["fail"] == true {
+			return errors.New("Unable to save")
+		}
+		saved++
+		return nil
+	}}
+
+	failing := &Measurement{
+		Name:       "combined",
+		Values:     good.Values,
+		Dimensions: map[string]interface{}{"fail": true},
+	}
+
+	post := func(measurements ...*Measurement) (int, *Result) {
+		b, _ := json.Marshal(measurements)
+		resp := postMeasurements(h, ContentTypeJSON, b, nil)
+		result := &Result{}
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(result))
+		return resp.Code, result
+	}
+
+	status, result := post(good, missingName, failing, emptyValues, missingTS)
+	assert.Equal(t, http.StatusCreated, status)
+	assert.Equal(t, 2, result.Accepted)
+	assert.Equal(t, 2, saved)
+	assert.Equal(t, []int{2}, result.Failed)
+	if assert.Len(t, result.Rejected, 2) {
+		assert.Equal(t, &Rejection{1, "Missing name"}, result.Rejected[0])
+		assert.Equal(t, &Rejection{3, "Need at least one value"}, result.Rejected[1])
+	}
+
+	status, result = post(failing)
+	assert.Equal(t, http.StatusInternalServerError, status)
+	assert.Equal(t, []int{0}, result.Failed)
+
+	status, result = post(missingValues)
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Len(t, result.Rejected, 1)
+}
+
+func TestHistograms(t *testing.T) {
+	var saved []*Measurement
+	h := &Handler{Save: func(m *Measurement) error {
+		saved = append(saved, m)
+		return nil
+	}, Quantiles: []float64{0.5, 0.999}}
+
+	// Bins for the values 1 through 1000, as built by the client
+	accuracy := 0.01
+	logGamma := math.Log((1 + accuracy) / (1 - accuracy))
+	counts := make(map[int]float64)
+	for i := 1; i <= 1000; i++ {
+		counts[int(math.Ceil(math.Log(float64(i))/logGamma))]++
+	}
+	var pos []float64
+	for idx, count := range counts {
+		pos = append(pos, float64(idx), count)
+	}
+	histogram, _ := json.Marshal(map[string]interface{}{
+		"type":     "histogram",
+		"accuracy": accuracy,
+		"pos":      pos,
+		"sum":      500500,
+	})
+
+	body := `[{"name": "requests", "values": {"count": 1000, "latency": ` + string(histogram) + `}}]`
+	resp := postMeasurements(h, ContentTypeJSON, []byte(body), nil)
+	assert.Equal(t, http.StatusCreated, resp.Code)
+	if assert.Len(t, saved, 1) {
+		values := saved[0].Values
+		assert.Len(t, values, 3)
+		assert.EqualValues(t, 1000, values["count"])
+		assert.InEpsilon(t, 500, values["latency_p50"], accuracy)
+		assert.InEpsilon(t, 999, values["latency_p99_9"], accuracy)
+	}
+
+	body = `[{"name": "requests", "values": {"latency": {"type": "unknown"}}}]`
+	resp = postMeasurements(h, ContentTypeJSON, []byte(body), nil)
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+}
@@ -0,0 +1,165 @@
+package borda
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+
+	"github.com/getlantern/errors"
+)
+
+const (
+	// DefaultMaxBodyBytes is the default for Handler.MaxBodyBytes
+	DefaultMaxBodyBytes = 10 * 1024 * 1024
+
+	// DefaultMaxBatchSize is the default for Handler.MaxBatchSize
+	DefaultMaxBatchSize = 100000
+
+	// DefaultMaxValues is the default for Handler.MaxValues
+	DefaultMaxValues = 1000
+
+	// DefaultMaxDimensions is the default for Handler.MaxDimensions
+	DefaultMaxDimensions = 1000
+
+	// DefaultMaxKeyLength is the default for Handler.MaxKeyLength
+	DefaultMaxKeyLength = 256
+
+	// DefaultMaxValueLength is the default for Handler.MaxValueLength
+	DefaultMaxValueLength = 4096
+)
+
+var (
+	errBodyTooLarge  = errors.New("body too large")
+	errBatchTooLarge = errors.New("batch too large")
+	errNotABatch     = errors.New("expected an array of measurements")
+
+	// limitsExceeded counts how often each of the Handler's limits was
+	// exceeded, exported as borda.limits_exceeded.
+	limitsExceeded = new(expvar.Map).Init()
+)
+
+func init() {
+	stats.Set("limits_exceeded", limitsExceeded)
+}
+
+// applyLimitDefaults fills in the default for each limit that isn't set.
+func (h *Handler) applyLimitDefaults() {
+	if h.MaxDecompressedBytes <= 0 {
+		h.MaxDecompressedBytes = DefaultMaxDecompressedBytes
+	}
+	if h.MaxBodyBytes <= 0 {
+		h.MaxBodyBytes = DefaultMaxBodyBytes
+	}
+	if h.MaxBatchSize <= 0 {
+		h.MaxBatchSize = DefaultMaxBatchSize
+	}
+	if h.MaxValues <= 0 {
+		h.MaxValues = DefaultMaxValues
+	}
+	if h.MaxDimensions <= 0 {
+		h.MaxDimensions = DefaultMaxDimensions
+	}
+	if h.MaxKeyLength <= 0 {
+		h.MaxKeyLength = DefaultMaxKeyLength
+	}
+	if h.MaxValueLength <= 0 {
+		h.MaxValueLength = DefaultMaxValueLength
+	}
+}
+
+// decodeBatch decodes a JSON array of measurements one measurement at a time,
+// failing with errBatchTooLarge as soon as it exceeds MaxBatchSize.
+func (h *Handler) decodeBatch(dec *json.Decoder) ([]*Measurement, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	if tok == nil {
+		// null
+		return nil, nil
+	}
+	if tok != json.Delim('[') {
+		return nil, errNotABatch
+	}
+	var measurements []*Measurement
+	for dec.More() {
+		if len(measurements) >= h.MaxBatchSize {
+			return nil, errBatchTooLarge
+		}
+		m := &Measurement{}
+		err = dec.Decode(m)
+		if err != nil {
+			return nil, err
+		}
+		measurements = append(measurements, m)
+	}
+	_, err = dec.Token()
+	return measurements, err
+}
+
+// decodeFailed answers a request whose body couldn't be read or decoded,
+// distinguishing the limits that the body exceeded.
+func (h *Handler) decodeFailed(resp http.ResponseWriter, err error) {
+	status, reason := h.decodeFailure(err)
+	resp.WriteHeader(status)
+	fmt.Fprintln(resp, reason)
+}
+
+// decodeFailure counts the limit that err exceeded, if any, and returns the
+// status and reason with which to answer the request.
+func (h *Handler) decodeFailure(err error) (int, string) {
+	switch err {
+	case errBodyTooLarge:
+		limitsExceeded.Add("body_bytes", 1)
+		return http.StatusRequestEntityTooLarge, fmt.Sprintf("Body exceeds %d bytes", h.MaxBodyBytes)
+	case errDecompressedTooLarge:
+		limitsExceeded.Add("decompressed_bytes", 1)
+		return http.StatusRequestEntityTooLarge, fmt.Sprintf("Decompressed body exceeds %d bytes", h.MaxDecompressedBytes)
+	case errBatchTooLarge:
+		limitsExceeded.Add("batch_size", 1)
+		return http.StatusRequestEntityTooLarge, fmt.Sprintf("Batch exceeds %d measurements", h.MaxBatchSize)
+	default:
+		return http.StatusBadRequest, fmt.Sprintf("Error decoding JSON: %v", err)
+	}
+}
+
+// checkLimits returns the reason for which the given measurement exceeds the
+// Handler's limits, or "" if it doesn't.
+func (h *Handler) checkLimits(m *Measurement) string {
+	if len(m.Name) > h.MaxKeyLength {
+		limitsExceeded.Add("key_length", 1)
+		return fmt.Sprintf("Name exceeds %d bytes", h.MaxKeyLength)
+	}
+	if len(m.Values)+len(m.Histograms) > h.MaxValues {
+		limitsExceeded.Add("values", 1)
+		return fmt.Sprintf("Too many values, maximum is %d", h.MaxValues)
+	}
+	if len(m.Dimensions) > h.MaxDimensions {
+		limitsExceeded.Add("dimensions", 1)
+		return fmt.Sprintf("Too many dimensions, maximum is %d", h.MaxDimensions)
+	}
+	for key := range m.Values {
+		if len(key) > h.MaxKeyLength {
+			limitsExceeded.Add("key_length", 1)
+			return fmt.Sprintf("Value key exceeds %d bytes", h.MaxKeyLength)
+		}
+	}
+	for key := range m.Histograms {
+		if len(key) > h.MaxKeyLength {
+			limitsExceeded.Add("key_length", 1)
+			return fmt.Sprintf("Value key exceeds %d bytes", h.MaxKeyLength)
+		}
+	}
+	for key, value := range m.Dimensions {
+		if len(key) > h.MaxKeyLength {
+			limitsExceeded.Add("key_length", 1)
+			return fmt.Sprintf("Dimension key exceeds %d bytes", h.MaxKeyLength)
+		}
+		if s, ok := value.(string); ok && len(s) > h.MaxValueLength {
+			limitsExceeded.Add("value_length", 1)
+			return fmt.Sprintf("Dimension value exceeds %d bytes", h.MaxValueLength)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,87 @@
+package borda
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLimits(t *testing.T) {
+	saved := 0
+	h := &Handler{
+		Save: func(m *Measurement) error {
+			saved++
+			return nil
+		},
+		MaxBatchSize:   2,
+		MaxValues:      1,
+		MaxDimensions:  3,
+		MaxKeyLength:   20,
+		MaxValueLength: 5,
+	}
+	batch := func(measurements ...*Measurement) []byte {
+		b, _ := json.Marshal(measurements)
+		return b
+	}
+	withValues := func(values map[string]float64) *Measurement {
+		return &Measurement{Name: "combined", Values: values, Dimensions: good.Dimensions}
+	}
+	withDimensions := func(dims map[string]interface{}) *Measurement {
+		return &Measurement{Name: "combined", Values: good.Values, Dimensions: dims}
+	}
+
+	resp := postMeasurements(h, ContentTypeJSON, batch(good, good, good), nil)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.Code)
+	assert.Equal(t, "Batch exceeds 2 measurements\n", resp.Body.String())
+
+	resp = postMeasurements(h, ContentTypeJSON, []byte(`{"name": "combined"}`), nil)
+	assert.Equal(t, http.StatusBadRequest, resp.Code, "Body that isn't an array should be rejected")
+
+	for _, test := range []struct {
+		m      *Measurement
+		reason string
+	}{
+		{&Measurement{Name: strings.Repeat("n", 21), Values: good.Values}, "Name exceeds 20 bytes"},
+		{withValues(map[string]float64{"a": 1, "b": 2}), "Too many values, maximum is 1"},
+		{withValues(map[string]float64{strings.Repeat("v", 21): 1}), "Value key exceeds 20 bytes"},
+		{withDimensions(map[string]interface{}{"a": 1, "b": 2, "c": 3, "d": 4}), "Too many dimensions, maximum is 3"},
+		{withDimensions(map[string]interface{}{strings.Repeat("d", 21): 1}), "Dimension key exceeds 20 bytes"},
+		{withDimensions(map[string]interface{}{"d": "toolong"}), "Dimension value exceeds 5 bytes"},
+	} {
+		resp = postMeasurements(h, ContentTypeJSON, batch(good, test.m), nil)
+		assert.Equal(t, http.StatusCreated, resp.Code)
+		result := &Result{}
+		if assert.NoError(t, json.NewDecoder(resp.Body).Decode(result)) {
+			assert.Equal(t, []*Rejection{{1, test.reason}}, result.Rejected)
+		}
+	}
+
+	ndjson := new(bytes.Buffer)
+	enc := json.NewEncoder(ndjson)
+	for i := 0; i < 3; i++ {
+		enc.Encode(good)
+	}
+	resp = postMeasurements(h, ContentTypeNDJSON, ndjson.Bytes(), nil)
+	assert.Equal(t, http.StatusCreated, resp.Code)
+	result := &Result{}
+	if assert.NoError(t, json.NewDecoder(resp.Body).Decode(result)) {
+		assert.Equal(t, 2, result.Accepted)
+		assert.Equal(t, []*Rejection{{2, "Batch exceeds 2 measurements"}}, result.Rejected)
+	}
+
+	h.MaxBodyBytes = 10
+	resp = postMeasurements(h, ContentTypeJSON, batch(good), nil)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.Code)
+	assert.Equal(t, "Body exceeds 10 bytes\n", resp.Body.String())
+	resp = postMeasurements(h, ContentTypeNDJSON, ndjson.Bytes(), nil)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.Code)
+
+	assert.Equal(t, 6+2, saved)
+	for _, limit := range []string{"body_bytes", "batch_size", "values", "dimensions", "key_length", "value_length"} {
+		assert.NotNil(t, limitsExceeded.Get(limit), "Exceeding %v should have been counted", limit)
+	}
+}
@@ -0,0 +1,285 @@
+package borda
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/yaml"
+)
+
+// Stage is a stage in a pipeline of SaveFuncs. It wraps the next SaveFunc in
+// the pipeline, which it may call zero or more times for each measurement.
+type Stage func(next SaveFunc) SaveFunc
+
+// Pipeline returns a SaveFunc that passes measurements through the given stages
+// in order before saving them with save.
+func Pipeline(save SaveFunc, stages ...Stage) SaveFunc {
+	for i := len(stages) - 1; i >= 0; i-- {
+		save = stages[i](save)
+	}
+	return save
+}
+
+// Drop drops measurements for which rule returns true.
+func Drop(rule func(m *Measurement) bool) Stage {
+	return func(next SaveFunc) SaveFunc {
+		return func(m *Measurement) error {
+			if rule(m) {
+				return nil
+			}
+			return next(m)
+		}
+	}
+}
+
+// RenameDimension renames the dimension from to to on measurements matching the
+// given name pattern (as understood by path.Match), overwriting any existing
+// dimension to.
+func RenameDimension(pattern string, from string, to string) Stage {
+	return func(next SaveFunc) SaveFunc {
+		return func(m *Measurement) error {
+			if val, found := m.Dimensions[from]; found && nameMatches(pattern, m.Name) {
+				delete(m.Dimensions, from)
+				m.Dimensions[to] = val
+			}
+			return next(m)
+		}
+	}
+}
+
+// DeriveValue adds the value name to measurements matching the given name
+// pattern. The value is calculated by derive, which returns false if it can't be
+// calculated for the given measurement, in which case the value isn't added.
+func DeriveValue(pattern string, name string, derive func(m *Measurement) (float64, bool)) Stage {
+	return func(next SaveFunc) SaveFunc {
+		return func(m *Measurement) error {
+			if nameMatches(pattern, m.Name) {
+				if val, ok := derive(m); ok {
+					if m.Values == nil {
+						m.Values = make(map[string]float64)
+					}
+					m.Values[name] = val
+				}
+			}
+			return next(m)
+		}
+	}
+}
+
+// Tee saves measurements with other before passing them on to the rest of the
+// pipeline. Errors from other are logged but don't stop the pipeline.
+func Tee(other SaveFunc) Stage {
+	return func(next SaveFunc) SaveFunc {
+		return func(m *Measurement) error {
+			if err := other(m); err != nil {
+				log.Errorf("Unable to tee measurement %v: %v", m.Name, err)
+			}
+			return next(m)
+		}
+	}
+}
+
+// FileSave creates a SaveFunc that appends measurements to the given file as
+// newline-delimited JSON.
+func FileSave(file string) (SaveFunc, error) {
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, errors.New("Unable to open %v: %v", file, err)
+	}
+	var mx sync.Mutex
+	enc := json.NewEncoder(f)
+	return func(m *Measurement) error {
+		mx.Lock()
+		defer mx.Unlock()
+		return enc.Encode(m)
+	}, nil
+}
+
+func nameMatches(pattern string, name string) bool {
+	if pattern == "" {
+		return true
+	}
+	matched, _ := path.Match(pattern, name)
+	return matched
+}
+
+type pipelineConfig struct {
+	Stages []*stageConfig `yaml:"stages"`
+}
+
+// stageConfig configures a single stage, only one of whose fields may be set.
+type stageConfig struct {
+	Drop   *dropConfig   `yaml:"drop"`
+	Rename *renameConfig `yaml:"rename"`
+	Derive *deriveConfig `yaml:"derive"`
+	Tee    *teeConfig    `yaml:"tee"`
+}
+
+type dropConfig struct {
+	Name       string            `yaml:"name"`
+	Dimensions map[string]string `yaml:"dimensions"`
+}
+
+type renameConfig struct {
+	Name string `yaml:"name"`
+	From string `yaml:"from"`
+	To   string `yaml:"to"`
+}
+
+type deriveConfig struct {
+	Name  string `yaml:"name"`
+	Value string `yaml:"value"`
+	A     string `yaml:"a"`
+	Op    string `yaml:"op"`
+	B     string `yaml:"b"`
+}
+
+type teeConfig struct {
+	File string `yaml:"file"`
+}
+
+// LoadPipeline loads a pipeline of stages from the given YAML file and puts it
+// in front of save. The file looks like:
+//
+//	stages:
+//	  - drop:
+//	      name: debug_*
+//	      dimensions:
+//	        app: test
+//	  - rename:
+//	      name: proxy_*
+//	      from: proxy
+//	      to: proxy_host
+//	  - derive:
+//	      name: client_results
+//	      value: error_rate
+//	      a: error_count
+//	      op: /
+//	      b: request_count
+//	  - tee:
+//	      file: measurements.ndjson
+//
+// Names are patterns as understood by path.Match and are optional, matching
+// all measurements if omitted. drop drops measurements matching the name and
+// all of the given dimensions. derive supports the operators +, -, * and /. If
+// the file doesn't exist, the pipeline is empty.
+func LoadPipeline(file string, save SaveFunc) (SaveFunc, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			log.Debugf("Pipeline file %v not found, saving measurements as they are", file)
+			return save, nil
+		}
+		return nil, errors.New("Unable to read pipeline file %v: %v", file, err)
+	}
+	cfg := &pipelineConfig{}
+	err = yaml.Unmarshal(b, cfg)
+	if err != nil {
+		return nil, errors.New("Unable to parse pipeline file %v: %v", file, err)
+	}
+	stages := make([]Stage, 0, len(cfg.Stages))
+	for i, sc := range cfg.Stages {
+		stage, buildErr := sc.build()
+		if buildErr != nil {
+			return nil, errors.New("Invalid stage %d in pipeline file %v: %v", i, file, buildErr)
+		}
+		stages = append(stages, stage)
+	}
+	log.Debugf("Loaded pipeline with %d stages from %v", len(stages), file)
+	return Pipeline(save, stages...), nil
+}
+
+func (sc *stageConfig) build() (Stage, error) {
+	var stages []Stage
+	var name string
+	if sc.Drop != nil {
+		name = sc.Drop.Name
+		stage, err := sc.Drop.build()
+		if err != nil {
+			return nil, err
+		}
+		stages = append(stages, stage)
+	}
+	if sc.Rename != nil {
+		name = sc.Rename.Name
+		if sc.Rename.From == "" || sc.Rename.To == "" {
+			return nil, errors.New("rename needs from and to")
+		}
+		stages = append(stages, RenameDimension(sc.Rename.Name, sc.Rename.From, sc.Rename.To))
+	}
+	if sc.Derive != nil {
+		name = sc.Derive.Name
+		stage, err := sc.Derive.build()
+		if err != nil {
+			return nil, err
+		}
+		stages = append(stages, stage)
+	}
+	if sc.Tee != nil {
+		if sc.Tee.File == "" {
+			return nil, errors.New("tee needs a file")
+		}
+		save, err := FileSave(sc.Tee.File)
+		if err != nil {
+			return nil, err
+		}
+		stages = append(stages, Tee(save))
+	}
+	if len(stages) != 1 {
+		return nil, errors.New("Stage needs exactly one of drop, rename, derive or tee")
+	}
+	if _, err := path.Match(name, ""); err != nil {
+		return nil, errors.New("Invalid name pattern %v: %v", name, err)
+	}
+	return stages[0], nil
+}
+
+func (dc *dropConfig) build() (Stage, error) {
+	if dc.Name == "" && len(dc.Dimensions) == 0 {
+		return nil, errors.New("drop needs a name or dimensions")
+	}
+	return Drop(func(m *Measurement) bool {
+		if !nameMatches(dc.Name, m.Name) {
+			return false
+		}
+		for dim, expected := range dc.Dimensions {
+			val, found := m.Dimensions[dim]
+			if !found || fmt.Sprint(val) != expected {
+				return false
+			}
+		}
+		return true
+	}), nil
+}
+
+func (dc *deriveConfig) build() (Stage, error) {
+	if dc.Value == "" || dc.A == "" || dc.B == "" {
+		return nil, errors.New("derive needs value, a and b")
+	}
+	var op func(a float64, b float64) (float64, bool)
+	switch dc.Op {
+	case "+":
+		op = func(a float64, b float64) (float64, bool) { return a + b, true }
+	case "-":
+		op = func(a float64, b float64) (float64, bool) { return a - b, true }
+	case "*":
+		op = func(a float64, b float64) (float64, bool) { return a * b, true }
+	case "/":
+		op = func(a float64, b float64) (float64, bool) { return a / b, b != 0 }
+	default:
+		return nil, errors.New("Unknown operator %v", dc.Op)
+	}
+	return DeriveValue(dc.Name, dc.Value, func(m *Measurement) (float64, bool) {
+		a, foundA := m.Values[dc.A]
+		b, foundB := m.Values[dc.B]
+		if !foundA || !foundB {
+			return 0, false
+		}
+		return op(a, b)
+	}), nil
+}
@@ -0,0 +1,124 @@
+package borda
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPipeline(t *testing.T) {
+	var saved []*Measurement
+	save := func(m *Measurement) error {
+		saved = append(saved, m)
+		return nil
+	}
+	var teed int
+	pipeline := Pipeline(save,
+		Drop(func(m *Measurement) bool { return m.Name == "dropped" }),
+		RenameDimension("proxy_*", "proxy", "proxy_host"),
+		DeriveValue("", "double", func(m *Measurement) (float64, bool) {
+			val, found := m.Values["v"]
+			return val * 2, found
+		}),
+		Tee(func(m *Measurement) error {
+			teed++
+			return nil
+		}),
+	)
+
+	assert.NoError(t, pipeline(&Measurement{Name: "dropped", Values: map[string]float64{"v": 1}}))
+	assert.NoError(t, pipeline(&Measurement{Name: "proxy_a", Values: map[string]float64{"v": 1}, Dimensions: map[string]interface{}{"proxy": "a"}}))
+	assert.NoError(t, pipeline(&Measurement{Name: "client", Values: map[string]float64{"w": 1}, Dimensions: map[string]interface{}{"proxy": "b"}}))
+	assert.Equal(t, 2, teed)
+	if assert.Len(t, saved, 2) {
+		assert.Equal(t, map[string]interface{}{"proxy_host": "a"}, saved[0].Dimensions)
+		assert.Equal(t, map[string]float64{"v": 1, "double": 2}, saved[0].Values)
+		assert.Equal(t, map[string]interface{}{"proxy": "b"}, saved[1].Dimensions, "Only matching measurements should have been renamed")
+		assert.Equal(t, map[string]float64{"w": 1}, saved[1].Values)
+	}
+}
+
+func TestLoadPipeline(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pipeline")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	var saved []*Measurement
+	save := func(m *Measurement) error {
+		saved = append(saved, m)
+		return nil
+	}
+
+	pipeline, err := LoadPipeline(filepath.Join(dir, "missing.yaml"), save)
+	if assert.NoError(t, err) {
+		assert.NoError(t, pipeline(&Measurement{Name: "a"}))
+		assert.Len(t, saved, 1)
+	}
+
+	teeFile := filepath.Join(dir, "tee.ndjson")
+	file := filepath.Join(dir, "pipeline.yaml")
+	err = ioutil.WriteFile(file, []byte(`
+stages:
+  - drop:
+      dimensions:
+        app: test
+  - rename:
+      from: ip
+      to: client_ip
+  - derive:
+      value: error_rate
+      a: error_count
+      op: /
+      b: request_count
+  - tee:
+      file: `+teeFile+`
+`), 0644)
+	if !assert.NoError(t, err) {
+		return
+	}
+	saved = nil
+	pipeline, err = LoadPipeline(file, save)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, pipeline(&Measurement{Name: "a", Values: map[string]float64{"error_count": 1}, Dimensions: map[string]interface{}{"app": "test"}}))
+	assert.NoError(t, pipeline(&Measurement{Name: "a", Values: map[string]float64{"error_count": 1, "request_count": 4}, Dimensions: map[string]interface{}{"app": "prod", "ip": "1.2.3.4"}}))
+	assert.NoError(t, pipeline(&Measurement{Name: "a", Values: map[string]float64{"error_count": 1, "request_count": 0}, Dimensions: map[string]interface{}{}}))
+	if assert.Len(t, saved, 2) {
+		assert.Equal(t, map[string]interface{}{"app": "prod", "client_ip": "1.2.3.4"}, saved[0].Dimensions)
+		assert.Equal(t, 0.25, saved[0].Values["error_rate"])
+		assert.NotContains(t, saved[1].Values, "error_rate", "Division by zero shouldn't derive a value")
+	}
+
+	f, err := os.Open(teeFile)
+	if assert.NoError(t, err) {
+		defer f.Close()
+		lines := 0
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			m := &Measurement{}
+			assert.NoError(t, json.Unmarshal(scanner.Bytes(), m))
+			lines++
+		}
+		assert.Equal(t, 2, lines)
+	}
+
+	for _, bad := range []string{
+		"stages:\n  - drop: {}\n",
+		"stages:\n  - rename:\n      from: a\n",
+		"stages:\n  - derive:\n      value: a\n      a: b\n      op: '%'\n      b: c\n",
+		"stages:\n  - {}\n",
+		"stages:\n  - drop:\n      name: '['\n",
+	} {
+		assert.NoError(t, ioutil.WriteFile(file, []byte(bad), 0644))
+		_, err = LoadPipeline(file, save)
+		assert.Error(t, err, bad)
+	}
+}
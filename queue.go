@@ -0,0 +1,100 @@
+package borda
+
+import (
+	"expvar"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultQueueWorkers is the default for Handler.QueueWorkers
+	DefaultQueueWorkers = 4
+
+	// DefaultRetryAfter is the default for Handler.RetryAfter
+	DefaultRetryAfter = 10 * time.Second
+)
+
+// queuedMeasurement is a measurement waiting in the queue to be saved.
+type queuedMeasurement struct {
+	m        *Measurement
+	enqueued time.Time
+}
+
+// startQueue starts the queue and its workers if the Handler is configured to
+// queue measurements.
+func (h *Handler) startQueue() {
+	if h.QueueSize <= 0 {
+		return
+	}
+	if h.QueueWorkers <= 0 {
+		h.QueueWorkers = DefaultQueueWorkers
+	}
+	if h.RetryAfter <= 0 {
+		h.RetryAfter = DefaultRetryAfter
+	}
+	h.queue = make(chan *queuedMeasurement, h.QueueSize)
+	stats.Set("queue_depth", expvar.Func(func() interface{} {
+		return atomic.LoadInt64(&h.queueDepth)
+	}))
+	stats.Set("queue_capacity", expvar.Func(func() interface{} {
+		return h.QueueSize
+	}))
+	log.Debugf("Saving measurements from a queue of %d with %d workers", h.QueueSize, h.QueueWorkers)
+	for i := 0; i < h.QueueWorkers; i++ {
+		go h.saveQueued()
+	}
+}
+
+// saveQueued saves measurements from the queue. It tracks the total time that
+// measurements waited in the queue and took to save, from which average
+// latencies can be calculated using queue_saved.
+func (h *Handler) saveQueued() {
+	for qm := range h.queue {
+		atomic.AddInt64(&h.queueDepth, -1)
+		start := time.Now()
+		stats.AddFloat("queue_wait_ms_total", start.Sub(qm.enqueued).Seconds()*1000)
+		err := h.Save(qm.m)
+		stats.AddFloat("queue_save_ms_total", time.Since(start).Seconds()*1000)
+		stats.Add("queue_saved", 1)
+		if err != nil {
+			log.Errorf("Error saving queued measurement, continuing: %v", err)
+			stats.Add("queue_save_errors", 1)
+		}
+	}
+}
+
+// reserve reserves room in the queue for n measurements, returning false if the
+// queue doesn't have room for all of them. When not queueing, this always
+// returns true.
+func (h *Handler) reserve(n int) bool {
+	if h.queue == nil {
+		return true
+	}
+	for {
+		depth := atomic.LoadInt64(&h.queueDepth)
+		if depth+int64(n) > int64(h.QueueSize) {
+			stats.Add("queue_full", 1)
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&h.queueDepth, depth, depth+int64(n)) {
+			return true
+		}
+	}
+}
+
+// release releases room reserved for n measurements that weren't enqueued.
+func (h *Handler) release(n int) {
+	if h.queue != nil && n > 0 {
+		atomic.AddInt64(&h.queueDepth, -1*int64(n))
+	}
+}
+
+// save saves the measurement, either directly or by enqueueing it into room
+// previously reserved with reserve.
+func (h *Handler) save(m *Measurement) error {
+	if h.queue == nil {
+		return h.Save(m)
+	}
+	h.queue <- &queuedMeasurement{m, time.Now()}
+	return nil
+}
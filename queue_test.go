@@ -0,0 +1,81 @@
+package borda
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueue(t *testing.T) {
+	unblock := make(chan bool)
+	saved := make(chan *Measurement, 10)
+	h := &Handler{
+		Save: func(m *Measurement) error {
+			<-unblock
+			saved <- m
+			return nil
+		},
+		QueueSize:    2,
+		QueueWorkers: 1,
+		RetryAfter:   30 * time.Second,
+	}
+
+	post := func(contentType string, measurements ...*Measurement) *httptest.ResponseRecorder {
+		body := new(bytes.Buffer)
+		if contentType == ContentTypeNDJSON {
+			enc := json.NewEncoder(body)
+			for _, m := range measurements {
+				enc.Encode(m)
+			}
+		} else {
+			json.NewEncoder(body).Encode(measurements)
+		}
+		return postMeasurements(h, contentType, body.Bytes(), nil)
+	}
+
+	// The worker takes the first measurement and blocks saving it, leaving room
+	// for two more in the queue
+	assert.Equal(t, http.StatusCreated, post(ContentTypeJSON, good).Code)
+	for i := 0; i < 100 && atomic.LoadInt64(&h.queueDepth) > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	resp := post(ContentTypeJSON, good, good, good)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.Code, "Batch larger than queue should never be admitted")
+
+	resp = post(ContentTypeJSON, good, missingName)
+	assert.Equal(t, http.StatusCreated, resp.Code)
+	assert.EqualValues(t, 1, atomic.LoadInt64(&h.queueDepth), "Room reserved for rejected measurement should have been released")
+
+	resp = post(ContentTypeJSON, good, good)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.Code, "Batch that doesn't fit in queue should be refused")
+	assert.Equal(t, "30", resp.Header().Get("Retry-After"))
+
+	resp = post(ContentTypeNDJSON, good, good)
+	assert.Equal(t, http.StatusCreated, resp.Code)
+	result := &Result{}
+	if assert.NoError(t, json.NewDecoder(resp.Body).Decode(result)) {
+		assert.Equal(t, 1, result.Accepted)
+		assert.Equal(t, []int{1}, result.Failed, "Measurement that doesn't fit in queue should have failed")
+	}
+
+	resp = post(ContentTypeNDJSON, good)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.Code)
+
+	close(unblock)
+	for i := 0; i < 3; i++ {
+		select {
+		case m := <-saved:
+			validateMeasurement(t, m)
+		case <-time.After(time.Second):
+			assert.Fail(t, "Queued measurement should have been saved")
+			return
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package borda
+
+import (
+	"expvar"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tokenBucket is a token bucket that holds up to burst tokens and is refilled
+// at rate tokens per second.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	mx     sync.Mutex
+}
+
+func newTokenBucket(rate float64, burst float64) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// take takes n tokens if available. If not, it takes nothing and returns false
+// along with how long it will take until n tokens are available. So that more
+// than burst tokens can be taken at once, a full bucket allows taking any
+// number of tokens, leaving it in debt until it's been refilled.
+func (b *tokenBucket) take(n float64, now time.Time) (bool, time.Duration) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	if now.After(b.last) {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+		b.last = now
+	}
+	needed := math.Min(n, b.burst)
+	if needed <= b.tokens {
+		b.tokens -= n
+		return true, 0
+	}
+	return false, time.Duration((needed - b.tokens) / b.rate * float64(time.Second))
+}
+
+const (
+	// rateLimiterIdleTimeout is how long a client's buckets are kept after its
+	// last request.
+	rateLimiterIdleTimeout = 10 * time.Minute
+
+	// DefaultMaxRateLimitedClients is the default for RateLimit.MaxClients
+	DefaultMaxRateLimitedClients = 100000
+)
+
+// RateLimit limits the requests and measurements per second that a single
+// client may submit. Zero rates aren't limited. Bursts default to one second's
+// worth of the rate.
+type RateLimit struct {
+	RequestsPerSecond     float64
+	RequestBurst          float64
+	MeasurementsPerSecond float64
+	MeasurementBurst      float64
+
+	// MaxClients caps the number of clients whose usage is tracked. Once it's
+	// reached, arbitrary clients are forgotten to make room for new ones.
+	// Defaults to DefaultMaxRateLimitedClients.
+	MaxClients int
+}
+
+// rateLimiter applies a RateLimit to each of many clients.
+type rateLimiter struct {
+	kind      string
+	limit     RateLimit
+	clients   map[string]*clientBuckets
+	lastSweep time.Time
+	mx        sync.Mutex
+}
+
+type clientBuckets struct {
+	requests     *tokenBucket
+	measurements *tokenBucket
+	lastSeen     time.Time
+	limited      bool
+}
+
+// newRateLimiter creates a limiter that counts limited clients under the given
+// kind (e.g. ip). If limit is nil, this returns nil, which doesn't limit
+// anything.
+func newRateLimiter(kind string, limit *RateLimit) *rateLimiter {
+	if limit == nil {
+		return nil
+	}
+	l := &rateLimiter{
+		kind:    kind,
+		limit:   *limit,
+		clients: make(map[string]*clientBuckets),
+	}
+	if l.limit.RequestBurst <= 0 {
+		l.limit.RequestBurst = math.Max(l.limit.RequestsPerSecond, 1)
+	}
+	if l.limit.MeasurementBurst <= 0 {
+		l.limit.MeasurementBurst = math.Max(l.limit.MeasurementsPerSecond, 1)
+	}
+	if l.limit.MaxClients <= 0 {
+		l.limit.MaxClients = DefaultMaxRateLimitedClients
+	}
+	stats.Set("rate_limited_"+kind+"s", expvar.Func(func() interface{} {
+		return l.numLimited()
+	}))
+	return l
+}
+
+// allow checks whether the client may submit a request with n measurements, or
+// n more measurements if request is false.
+func (l *rateLimiter) allow(client string, request bool, n int, now time.Time) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+	l.mx.Lock()
+	if now.Sub(l.lastSweep) > time.Minute {
+		l.sweep(now)
+	}
+	c := l.clients[client]
+	if c == nil {
+		if len(l.clients) >= l.limit.MaxClients {
+			l.sweep(now)
+			for id := range l.clients {
+				if len(l.clients) < l.limit.MaxClients {
+					break
+				}
+				delete(l.clients, id)
+				stats.Add("rate_limiter_"+l.kind+"_evictions", 1)
+			}
+		}
+		c = &clientBuckets{}
+		if l.limit.RequestsPerSecond > 0 {
+			c.requests = newTokenBucket(l.limit.RequestsPerSecond, l.limit.RequestBurst)
+		}
+		if l.limit.MeasurementsPerSecond > 0 {
+			c.measurements = newTokenBucket(l.limit.MeasurementsPerSecond, l.limit.MeasurementBurst)
+		}
+		l.clients[client] = c
+	}
+	c.lastSeen = now
+	l.mx.Unlock()
+
+	what := "measurements"
+	bucket, tokens := c.measurements, float64(n)
+	if request {
+		what = "requests"
+		bucket, tokens = c.requests, 1
+	}
+	if bucket == nil {
+		return true, 0
+	}
+	ok, wait := bucket.take(tokens, now)
+	if !ok {
+		stats.Add("rate_limited_"+l.kind+"_"+what, 1)
+		l.mx.Lock()
+		c.limited = true
+		l.mx.Unlock()
+	}
+	return ok, wait
+}
+
+// sweep forgets clients that have been idle for longer than
+// rateLimiterIdleTimeout. Callers must hold l.mx.
+func (l *rateLimiter) sweep(now time.Time) {
+	for id, c := range l.clients {
+		if now.Sub(c.lastSeen) > rateLimiterIdleTimeout {
+			delete(l.clients, id)
+		}
+	}
+	l.lastSweep = now
+}
+
+// numLimited returns the number of currently tracked clients that have been
+// rate limited.
+func (l *rateLimiter) numLimited() int {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	limited := 0
+	for _, c := range l.clients {
+		if c.limited {
+			limited++
+		}
+	}
+	return limited
+}
+
+// clientIP determines the IP of the client that made the request. If trustCDN
+// is true, it prefers the headers in which CDNs report it. Otherwise it uses the
+// address of the connection, since anyone can set those headers.
+func clientIP(req *http.Request, trustCDN bool) string {
+	if trustCDN {
+		if ip := req.Header.Get("Cf-Connecting-Ip"); ip != "" {
+			return ip
+		}
+		if addr := req.Header.Get("Cloudfront-Viewer-Address"); addr != "" {
+			// CloudFront reports the address as ip:port
+			if i := strings.LastIndex(addr, ":"); i > 0 {
+				return addr[:i]
+			}
+			return addr
+		}
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
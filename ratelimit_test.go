@@ -0,0 +1,87 @@
+package borda
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	b := newTokenBucket(10, 20)
+	b.last = now
+	ok, _ := b.take(15, now)
+	assert.True(t, ok)
+	ok, wait := b.take(10, now)
+	assert.False(t, ok)
+	assert.Equal(t, 500*time.Millisecond, wait)
+	ok, _ = b.take(10, now.Add(500*time.Millisecond))
+	assert.True(t, ok)
+
+	ok, _ = b.take(50, now.Add(10*time.Second))
+	assert.True(t, ok, "Full bucket should allow taking more than burst")
+	ok, wait = b.take(1, now.Add(10*time.Second))
+	assert.False(t, ok)
+	assert.Equal(t, 3100*time.Millisecond, wait)
+}
+
+func TestRateLimits(t *testing.T) {
+	h := &Handler{
+		Save: func(m *Measurement) error {
+			return nil
+		},
+		IPRateLimit:     &RateLimit{RequestsPerSecond: 0.001, RequestBurst: 2},
+		APIKeyRateLimit: &RateLimit{MeasurementsPerSecond: 0.001, MeasurementBurst: 1},
+		TrustCDNHeaders: true,
+	}
+	post := func(ip string, measurements ...*Measurement) *httptest.ResponseRecorder {
+		b, _ := json.Marshal(measurements)
+		return postMeasurements(h, ContentTypeJSON, b, map[string]string{"Cf-Connecting-Ip": ip})
+	}
+
+	assert.Equal(t, http.StatusCreated, post("1.1.1.1", good).Code)
+	assert.Equal(t, http.StatusCreated, post("1.1.1.1", good).Code)
+	resp := post("1.1.1.1", good)
+	assert.Equal(t, http.StatusTooManyRequests, resp.Code, "Requests beyond burst should be limited")
+	assert.NotEmpty(t, resp.Header().Get("Retry-After"))
+	assert.Equal(t, http.StatusCreated, post("2.2.2.2", good).Code, "Other IPs shouldn't be limited")
+	assert.Equal(t, 1, h.ipLimiter.numLimited())
+
+	// Without API keys, measurement limits per key don't apply
+	assert.Equal(t, http.StatusCreated, post("3.3.3.3", good, good).Code)
+	key := &APIKey{ID: "a"}
+	src := &source{"4.4.4.4", key}
+	assert.Nil(t, h.admit(src, 2), "Full bucket should admit batch larger than burst")
+	r := h.admit(src, 1)
+	if assert.NotNil(t, r) {
+		assert.Equal(t, http.StatusTooManyRequests, r.status)
+		assert.Equal(t, "Rate limit for API key exceeded", r.reason)
+	}
+	assert.Equal(t, 1, h.apiKeyLimiter.numLimited())
+}
+
+func TestRateLimiterMaxClients(t *testing.T) {
+	now := time.Now()
+	l := newRateLimiter("test", &RateLimit{RequestsPerSecond: 0.001, MaxClients: 2})
+	for _, client := range []string{"a", "b", "c", "d"} {
+		ok, _ := l.allow(client, true, 0, now)
+		assert.True(t, ok)
+		assert.True(t, len(l.clients) <= 2, "Number of tracked clients should be capped")
+	}
+	assert.Contains(t, l.clients, "d", "Newest client should be tracked")
+}
+
+func TestClientIP(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/measurements", nil)
+	req.RemoteAddr = "5.5.5.5:1234"
+	assert.Equal(t, "5.5.5.5", clientIP(req, true))
+	req.Header.Set("Cloudfront-Viewer-Address", "6.6.6.6:5678")
+	assert.Equal(t, "6.6.6.6", clientIP(req, true))
+	req.Header.Set("Cf-Connecting-Ip", "7.7.7.7")
+	assert.Equal(t, "7.7.7.7", clientIP(req, true))
+	assert.Equal(t, "5.5.5.5", clientIP(req, false), "CDN headers should be ignored unless trusted")
+}
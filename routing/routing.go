@@ -0,0 +1,73 @@
+// Package routing routes measurements to zenodb streams based on their names.
+// It's shared by the server and the client so that both route the same way.
+package routing
+
+import (
+	"path"
+	"sort"
+
+	"github.com/getlantern/errors"
+)
+
+const (
+	// DefaultStream is the stream to which measurements are routed if no other
+	// stream is configured.
+	DefaultStream = "inbound"
+)
+
+// Table is a routing table that maps measurement names to streams.
+type Table struct {
+	defaultStream string
+	routes        map[string]string
+	patterns      []string
+}
+
+// New constructs a new routing table. routes maps measurement names to stream
+// names. Keys may either be exact names or wildcard patterns as understood by
+// path.Match (e.g. "proxy_*"). Exact names take precedence over patterns and
+// longer patterns take precedence over shorter ones. Measurements that don't
+// match any route go to defaultStream, which itself defaults to DefaultStream.
+func New(defaultStream string, routes map[string]string) (*Table, error) {
+	if defaultStream == "" {
+		defaultStream = DefaultStream
+	}
+	t := &Table{
+		defaultStream: defaultStream,
+		routes:        make(map[string]string, len(routes)),
+	}
+	for pattern, stream := range routes {
+		if stream == "" {
+			return nil, errors.New("Route %v has no stream", pattern)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, errors.New("Invalid route pattern %v: %v", pattern, err)
+		}
+		t.routes[pattern] = stream
+		t.patterns = append(t.patterns, pattern)
+	}
+	sort.Slice(t.patterns, func(i, j int) bool {
+		a, b := t.patterns[i], t.patterns[j]
+		if len(a) != len(b) {
+			return len(a) > len(b)
+		}
+		return a < b
+	})
+	return t, nil
+}
+
+// StreamFor returns the stream to which measurements with the given name
+// should be routed. A nil Table routes everything to DefaultStream.
+func (t *Table) StreamFor(name string) string {
+	if t == nil {
+		return DefaultStream
+	}
+	if stream, found := t.routes[name]; found {
+		return stream
+	}
+	for _, pattern := range t.patterns {
+		if matched, _ := path.Match(pattern, name); matched {
+			return t.routes[pattern]
+		}
+	}
+	return t.defaultStream
+}
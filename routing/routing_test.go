@@ -0,0 +1,30 @@
+package routing
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStreamFor(t *testing.T) {
+	table, err := New("", map[string]string{
+		"proxy_*":       "proxies",
+		"proxy_errors*": "proxy_errors",
+		"client_errors": "clients",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "clients", table.StreamFor("client_errors"))
+	assert.Equal(t, "proxies", table.StreamFor("proxy_bandwidth"))
+	assert.Equal(t, "proxy_errors", table.StreamFor("proxy_errors_dial"))
+	assert.Equal(t, DefaultStream, table.StreamFor("client_results"))
+
+	var nilTable *Table
+	assert.Equal(t, DefaultStream, nilTable.StreamFor("anything"))
+
+	_, err = New("", map[string]string{"[": "bad"})
+	assert.Error(t, err)
+	_, err = New("", map[string]string{"proxy_*": ""})
+	assert.Error(t, err)
+}
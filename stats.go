@@ -0,0 +1,11 @@
+package borda
+
+import (
+	"expvar"
+)
+
+var (
+	// stats exports ingestion stats via expvar, which serves them at
+	// /debug/vars on the http.DefaultServeMux.
+	stats = expvar.NewMap("borda")
+)
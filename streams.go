@@ -0,0 +1,41 @@
+package borda
+
+import (
+	"io/ioutil"
+	"os"
+
+	"github.com/getlantern/borda/routing"
+	"github.com/getlantern/errors"
+	"github.com/getlantern/yaml"
+)
+
+type streamsConfig struct {
+	Default string            `yaml:"default"`
+	Routes  map[string]string `yaml:"routes"`
+}
+
+// LoadStreams loads a routing table (see routing.New) from the given YAML
+// file, which looks like:
+//
+//	default: inbound
+//	routes:
+//	  proxy_*: proxies
+//	  client_errors: clients
+//
+// If the file doesn't exist, everything is routed to routing.DefaultStream.
+func LoadStreams(file string) (*routing.Table, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			log.Debugf("Stream routing file %v not found, routing everything to %v", file, routing.DefaultStream)
+			return routing.New(routing.DefaultStream, nil)
+		}
+		return nil, errors.New("Unable to read stream routing file %v: %v", file, err)
+	}
+	cfg := &streamsConfig{}
+	err = yaml.Unmarshal(b, cfg)
+	if err != nil {
+		return nil, errors.New("Unable to parse stream routing file %v: %v", file, err)
+	}
+	return routing.New(cfg.Default, cfg.Routes)
+}
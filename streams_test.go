@@ -0,0 +1,35 @@
+package borda
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/getlantern/borda/routing"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadStreams(t *testing.T) {
+	dir, err := ioutil.TempDir("", "streams")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := LoadStreams(filepath.Join(dir, "missing.yaml"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, routing.DefaultStream, s.StreamFor("anything"))
+	}
+
+	file := filepath.Join(dir, "streams.yaml")
+	err = ioutil.WriteFile(file, []byte("default: other\nroutes:\n  team_*: team\n"), 0644)
+	if !assert.NoError(t, err) {
+		return
+	}
+	s, err = LoadStreams(file)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "team", s.StreamFor("team_latency"))
+		assert.Equal(t, "other", s.StreamFor("anything"))
+	}
+}
@@ -0,0 +1,50 @@
+package borda
+
+import (
+	"encoding/json"
+
+	"github.com/getlantern/borda/wire"
+	"github.com/getlantern/errors"
+)
+
+// decodeValue decodes the named value from its wire form (see wire.Value) and
+// stores it in the corresponding fields of the measurement.
+func (m *Measurement) decodeValue(key string, raw json.RawMessage) error {
+	tv := &wire.Value{}
+	if json.Unmarshal(raw, tv) != nil {
+		var val float64
+		err := json.Unmarshal(raw, &val)
+		if err != nil {
+			return errors.New("Invalid value for %v: %v", key, err)
+		}
+		m.Values[key] = val
+		return nil
+	}
+
+	switch tv.Type {
+	case wire.TypeSum, wire.TypeCount, wire.TypeMin, wire.TypeMax, wire.TypeLast:
+		if tv.V == nil {
+			return errors.New("Missing v for %v value %v", tv.Type, key)
+		}
+		m.Values[wire.FieldFor(key, tv.Type)] = *tv.V
+	case wire.TypeAvg:
+		m.Values[key+wire.AvgSumSuffix] = tv.Sum
+		m.Values[key+wire.AvgCountSuffix] = tv.Count
+	case wire.TypeRate:
+		m.Values[key+wire.AvgSumSuffix] = tv.Events
+		m.Values[key+wire.AvgCountSuffix] = tv.Seconds
+	case wire.TypeHistogram:
+		h := &Histogram{}
+		err := json.Unmarshal(raw, h)
+		if err != nil {
+			return errors.New("Invalid histogram for %v: %v", key, err)
+		}
+		if m.Histograms == nil {
+			m.Histograms = make(map[string]*Histogram)
+		}
+		m.Histograms[key] = h
+	default:
+		return errors.New("Unknown type %v for value %v", tv.Type, key)
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package borda
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTypedValues(t *testing.T) {
+	m := &Measurement{}
+	err := json.Unmarshal([]byte(`{"name": "requests", "values": {
+		"count": 5,
+		"errors": {"type": "sum", "v": 2},
+		"fastest": {"type": "min", "v": 1},
+		"slowest": {"type": "max", "v": 9},
+		"connections": {"type": "last", "v": 3},
+		"latency": {"type": "avg", "sum": 14, "count": 6},
+		"hits": {"type": "count", "v": 4},
+		"requests": {"type": "rate", "events": 30, "seconds": 60}
+	}}`), m)
+	if assert.NoError(t, err) {
+		assert.Equal(t, map[string]float64{
+			"count":             5,
+			"errors":            2,
+			"fastest__min":      1,
+			"slowest__max":      9,
+			"connections__last": 3,
+			"latency__sum":      14,
+			"latency__count":    6,
+			"hits":              4,
+			"requests__sum":     30,
+			"requests__count":   60,
+		}, m.Values)
+	}
+
+	invalid := func(values string) error {
+		m := &Measurement{}
+		assert.NoError(t, json.Unmarshal([]byte(`{"values": `+values+`}`), m), "Invalid values shouldn't fail decoding")
+		return m.valuesErr
+	}
+	assert.Error(t, invalid(`{"slowest": {"type": "max"}}`), "Missing v should fail")
+	assert.Error(t, invalid(`{"slowest": {"type": "unknown", "v": 1}}`), "Unknown type should fail")
+	assert.Error(t, invalid(`{"slowest": "text"}`), "Non-numeric value should fail")
+	assert.NoError(t, invalid(`{"slowest": 1}`))
+}
+
+func TestInvalidValueRejectsOnlyItsMeasurement(t *testing.T) {
+	saved := 0
+	h := &Handler{Save: func(m *Measurement) error {
+		saved++
+		return nil
+	}}
+	body := []byte(`[
+		{"name": "a", "values": {"v": 1}},
+		{"name": "b", "values": {"v": {"type": "unknown", "v": 1}}},
+		{"name": "c", "values": {"v": {"type": "max", "v": 3}}}
+	]`)
+	resp := postMeasurements(h, ContentTypeJSON, body, nil)
+	assert.Equal(t, http.StatusCreated, resp.Code)
+	result := &Result{}
+	if assert.NoError(t, json.NewDecoder(resp.Body).Decode(result)) {
+		assert.Equal(t, 2, result.Accepted)
+		if assert.Len(t, result.Rejected, 1) {
+			assert.Equal(t, 1, result.Rejected[0].Index)
+		}
+	}
+	assert.Equal(t, 2, saved)
+}
@@ -0,0 +1,129 @@
+// Package wire defines the format in which clients submit measurements to
+// borda, shared by the server and the client.
+package wire
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// SentAtHeader is the header in which clients report the time (in RFC3339
+	// format) at which they sent a batch, used to correct clock skew.
+	SentAtHeader = "X-Borda-Sent-At"
+
+	// APIKeyHeader is the header in which clients send their API key.
+	APIKeyHeader = "X-Borda-Api-Key"
+)
+
+// Types of values. Values are submitted either as plain numbers, which are
+// sums, or as typed values:
+//
+//	{"type": "sum", "v": 3}
+//	{"type": "count", "v": 3}
+//	{"type": "min", "v": 3}
+//	{"type": "max", "v": 3}
+//	{"type": "last", "v": 3, "ts": "2006-01-02T15:04:05Z"}
+//	{"type": "avg", "sum": 14, "count": 6}
+//	{"type": "rate", "events": 14, "seconds": 60}
+//	{"type": "histogram", ...} (see Histogram)
+//
+// Sums and counts are stored under the value's name. Since zenodb aggregates
+// whatever it stores, other types are stored in fields whose suffix identifies
+// how they need to be aggregated (see FieldFor), e.g. MAX(latency__max) or
+// SUM(latency__sum) / SUM(latency__count). The server doesn't reduce them
+// itself, so tables need to declare the matching aggregation, otherwise zenodb
+// sums them. Rates are stored like averages of events per second, weighted by
+// seconds. zenodb has no aggregation that keeps the most recent value, so lasts
+// are only the most recent value within a batch from one client.
+const (
+	TypeSum       = "sum"
+	TypeCount     = "count"
+	TypeMin       = "min"
+	TypeMax       = "max"
+	TypeLast      = "last"
+	TypeAvg       = "avg"
+	TypeRate      = "rate"
+	TypeHistogram = "histogram"
+)
+
+const (
+	// AvgSumSuffix and AvgCountSuffix name the fields in which the total and
+	// count of averaged values are stored, so that queries can calculate
+	// weighted averages like SUM(latency__sum) / SUM(latency__count).
+	AvgSumSuffix   = "__sum"
+	AvgCountSuffix = "__count"
+)
+
+// Value is the union of the forms of typed values, used to decode values
+// whose type isn't known yet. V is nil if it's missing.
+type Value struct {
+	Type    string    `json:"type"`
+	V       *float64  `json:"v"`
+	Ts      time.Time `json:"ts"`
+	Sum     float64   `json:"sum"`
+	Count   float64   `json:"count"`
+	Events  float64   `json:"events"`
+	Seconds float64   `json:"seconds"`
+}
+
+// Typed is the form of sums, counts, mins and maxes.
+type Typed struct {
+	Type string  `json:"type"`
+	V    float64 `json:"v"`
+}
+
+// Last is the form of lasts, which include the time at which they were
+// submitted so that the most recent one wins.
+type Last struct {
+	Type string    `json:"type"`
+	V    float64   `json:"v"`
+	Ts   time.Time `json:"ts"`
+}
+
+// Avg is the form of avgs, retaining their weight.
+type Avg struct {
+	Type  string  `json:"type"`
+	Sum   float64 `json:"sum"`
+	Count float64 `json:"count"`
+}
+
+// Rate is the form of rates.
+type Rate struct {
+	Type    string  `json:"type"`
+	Events  float64 `json:"events"`
+	Seconds float64 `json:"seconds"`
+}
+
+// Histogram is the compact form of histograms, which are DDSketches. Positive
+// and negative values are binned by the logarithm of their absolute value with
+// base gamma = (1 + accuracy) / (1 - accuracy). Bins are flattened into
+// alternating index and count.
+type Histogram struct {
+	Type     string    `json:"type"`
+	Accuracy float64   `json:"accuracy"`
+	Pos      []float64 `json:"pos,omitempty"`
+	Neg      []float64 `json:"neg,omitempty"`
+	Zeros    float64   `json:"zeros,omitempty"`
+	Sum      float64   `json:"sum"`
+}
+
+// FieldFor returns the name of the field in which a value of the given type is
+// stored. Avgs and histograms are stored in multiple fields, see AvgSumSuffix
+// and QuantileField.
+func FieldFor(name string, typ string) string {
+	switch typ {
+	case TypeMin, TypeMax, TypeLast:
+		return name + "__" + typ
+	default:
+		return name
+	}
+}
+
+// QuantileField names the field in which the given quantile of the named
+// histogram is stored, e.g. latency_p99 or latency_p99_9.
+func QuantileField(name string, q float64) string {
+	return fmt.Sprintf("%v_p%v", name, strings.Replace(strconv.FormatFloat(q*100, 'f', -1, 64), ".", "_", -1))
+}
@@ -0,0 +1,16 @@
+package wire
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFieldNames(t *testing.T) {
+	assert.Equal(t, "latency", FieldFor("latency", TypeSum))
+	assert.Equal(t, "latency", FieldFor("latency", TypeCount))
+	assert.Equal(t, "latency__max", FieldFor("latency", TypeMax))
+	assert.Equal(t, "latency__last", FieldFor("latency", TypeLast))
+	assert.Equal(t, "latency_p99", QuantileField("latency", 0.99))
+	assert.Equal(t, "latency_p99_9", QuantileField("latency", 0.999))
+}